@@ -1,6 +1,11 @@
 package ipam
 
-import "net"
+import (
+	"math/big"
+	"net"
+
+	"github.com/giantswarm/microerror"
+)
 
 // CalculateParent takes network as an input and returns one with 1 bit smaller
 // mask (yielding therefore 1 bit larger network).
@@ -30,3 +35,83 @@ func Filter(networks []net.IPNet, f func(n net.IPNet) bool) []net.IPNet {
 	}
 	return res
 }
+
+// Summarize takes a list of networks, and returns the minimal sorted list of
+// networks covering exactly the same addresses. Nested networks are dropped,
+// and adjacent networks are merged into their parents.
+// e.g: [10.4.0.0/24, 10.4.1.0/24, 10.4.1.128/25] -> [10.4.0.0/23]
+func Summarize(networks []net.IPNet) []net.IPNet {
+	return NewCIDRSet(networks).CIDRs()
+}
+
+// SummarizeLossy is like Summarize, but returns at most max networks, e.g.
+// for route tables with a limited number of entries. When the exact summary
+// has more networks, neighbouring networks are repeatedly replaced by their
+// smallest common parent, picking the replacement covering the fewest
+// additional addresses first. The number of addresses covered by the
+// returned networks which are not covered by the given networks is returned
+// as well. IPv4 and IPv6 networks are never merged with each other.
+func SummarizeLossy(networks []net.IPNet, max int) ([]net.IPNet, *big.Int, error) {
+	if max < 1 {
+		return nil, nil, microerror.Maskf(invalidParameterError, "max %d must be positive", max)
+	}
+
+	set := NewCIDRSet(networks)
+	exact := set.addressCount()
+
+	summary := set.CIDRs()
+	for len(summary) > max {
+		var best *CIDRSet
+		var bestCount *big.Int
+		for i := 0; i < len(summary)-1; i++ {
+			parent, ok := commonParent(summary[i], summary[i+1])
+			if !ok {
+				continue
+			}
+
+			merged := set.Union(NewCIDRSet([]net.IPNet{parent}))
+			count := merged.addressCount()
+			if bestCount == nil || count.Cmp(bestCount) < 0 {
+				best = &merged
+				bestCount = count
+			}
+		}
+
+		if best == nil {
+			return nil, nil, microerror.Maskf(invalidParameterError, "IPv4 and IPv6 networks cannot be summarized into at most %d networks", max)
+		}
+
+		set = *best
+		summary = set.CIDRs()
+	}
+
+	extra := set.addressCount()
+	extra.Sub(extra, exact)
+
+	return summary, extra, nil
+}
+
+// commonParent returns the smallest network containing both given networks.
+// ok is false when the networks are of different address families.
+func commonParent(a, b net.IPNet) (parent net.IPNet, ok bool) {
+	if ipLength(a.IP) != ipLength(b.IP) {
+		return net.IPNet{}, false
+	}
+
+	_, bits := a.Mask.Size()
+
+	// The parent keeps the bits both networks have in common.
+	diff := new(big.Int).Xor(ipToDecimal(a.IP), ipToDecimal(newIPRange(b).end))
+	ones := bits - diff.BitLen()
+	if aOnes, _ := a.Mask.Size(); aOnes < ones {
+		ones = aOnes
+	}
+
+	mask := net.CIDRMask(ones, bits)
+	parent = net.IPNet{
+		IP:   a.IP.Mask(mask),
+		Mask: mask,
+	}
+
+	return parent, true
+}
@@ -146,3 +146,136 @@ func Test_Filter(t *testing.T) {
 		})
 	}
 }
+
+func Test_Summarize(t *testing.T) {
+	testCases := []struct {
+		name     string
+		input    []string
+		expected []string
+	}{
+		{
+			name:     "case 0: summarize nothing",
+			expected: []string{},
+		},
+		{
+			name:     "case 1: merge siblings",
+			input:    []string{"10.4.0.0/24", "10.4.1.0/24", "10.4.2.0/24", "10.4.3.0/24"},
+			expected: []string{"10.4.0.0/22"},
+		},
+		{
+			name:     "case 2: do not merge adjacent networks which are not siblings",
+			input:    []string{"10.4.1.0/24", "10.4.2.0/24"},
+			expected: []string{"10.4.1.0/24", "10.4.2.0/24"},
+		},
+		{
+			name:     "case 3: drop nested networks",
+			input:    []string{"10.4.7.0/24", "10.4.0.0/16", "10.4.1.128/25"},
+			expected: []string{"10.4.0.0/16"},
+		},
+		{
+			name:     "case 4: merge unordered siblings of different sizes",
+			input:    []string{"10.4.3.0/24", "10.4.0.0/23", "10.4.2.0/25", "10.4.2.128/25"},
+			expected: []string{"10.4.0.0/22"},
+		},
+		{
+			name:     "case 5: ipv6 networks",
+			input:    []string{"fd00:0:0:1::/64", "fd00::/64", "10.4.0.0/24"},
+			expected: []string{"10.4.0.0/24", "fd00::/63"},
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output := cidrStrings(Summarize(mustParseCIDRs(tc.input)))
+
+			if !reflect.DeepEqual(output, tc.expected) {
+				t.Fatalf("got %v, want %v", output, tc.expected)
+			}
+		})
+	}
+}
+
+func Test_SummarizeLossy(t *testing.T) {
+	testCases := []struct {
+		name                 string
+		input                []string
+		max                  int
+		expected             []string
+		expectedExtra        int64
+		expectedErrorHandler func(error) bool
+	}{
+		{
+			name:     "case 0: exact summary within limit",
+			input:    []string{"10.4.0.0/24", "10.4.1.0/24", "10.4.8.0/24"},
+			max:      2,
+			expected: []string{"10.4.0.0/23", "10.4.8.0/24"},
+		},
+		{
+			name:          "case 1: merge the closest networks first",
+			input:         []string{"10.4.0.0/24", "10.4.2.0/24", "10.4.64.0/24"},
+			max:           2,
+			expected:      []string{"10.4.0.0/22", "10.4.64.0/24"},
+			expectedExtra: 2 * 256,
+		},
+		{
+			name:          "case 2: summarize into a single network",
+			input:         []string{"10.4.0.0/24", "10.4.2.0/24", "10.4.64.0/24"},
+			max:           1,
+			expected:      []string{"10.4.0.0/17"},
+			expectedExtra: 128*256 - 3*256,
+		},
+		{
+			name:          "case 3: merged parents absorb networks in between",
+			input:         []string{"10.4.0.0/24", "10.4.1.0/25", "10.4.3.0/24"},
+			max:           1,
+			expected:      []string{"10.4.0.0/22"},
+			expectedExtra: 256 + 128,
+		},
+		{
+			name:          "case 4: address families are summarized separately",
+			input:         []string{"10.4.0.0/24", "10.4.3.0/24", "fd00::/64", "fd00:0:0:3::/64"},
+			max:           3,
+			expected:      []string{"10.4.0.0/22", "fd00::/64", "fd00:0:0:3::/64"},
+			expectedExtra: 2 * 256,
+		},
+		{
+			name:                 "case 5: address families are never merged",
+			input:                []string{"10.4.0.0/24", "fd00::/64"},
+			max:                  1,
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 6: max must be positive",
+			input:                []string{"10.4.0.0/24"},
+			expectedErrorHandler: IsInvalidParameter,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			output, extra, err := SummarizeLossy(mustParseCIDRs(tc.input), tc.max)
+
+			switch {
+			case err == nil && tc.expectedErrorHandler == nil:
+				// correct; carry on
+			case err != nil && tc.expectedErrorHandler == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.expectedErrorHandler != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.expectedErrorHandler(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.expectedErrorHandler != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(cidrStrings(output), tc.expected) {
+				t.Fatalf("got %v, want %v", cidrStrings(output), tc.expected)
+			}
+			if extra.Int64() != tc.expectedExtra {
+				t.Fatalf("got %v extra addresses, want %v", extra, tc.expectedExtra)
+			}
+		})
+	}
+}
@@ -0,0 +1,380 @@
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/microstorage"
+)
+
+// Move describes moving a subnet to a new subnet of the same size, see
+// PlanDefragmentation and Service.MoveSubnet.
+type Move struct {
+	From net.IPNet
+	To   net.IPNet
+}
+
+// PlanDefragmentation returns the moves which maximize the largest free block
+// of the given network. The movable subnets may be moved, the fixed subnets
+// must stay where they are. Of all plans freeing a block of the largest
+// possible size, the one with the fewest moves is returned, preferring plans
+// which move fewer addresses, and then plans freeing a lower block. The
+// destinations of the moves never overlap with any of the given subnets, so
+// the moves may be applied in any order. No moves are returned when the
+// largest free block can not be made any larger.
+func PlanDefragmentation(network net.IPNet, movable, fixed []net.IPNet) ([]Move, error) {
+	network.IP = network.IP.Mask(network.Mask)
+	if network.IP == nil {
+		return nil, microerror.Maskf(invalidParameterError, "network %#q is invalid", network.String())
+	}
+	for _, subnet := range movable {
+		if !Contains(network, subnet) {
+			return nil, microerror.Maskf(ipNotContainedError, "%v is not contained by %v", subnet.String(), network.String())
+		}
+	}
+
+	var subnets []net.IPNet
+	subnets = append(subnets, movable...)
+	subnets = append(subnets, fixed...)
+
+	networkOnes, bits := network.Mask.Size()
+
+	// The prefix length of the largest free block, which is one more than
+	// the number of bits when the network is exhausted.
+	largest := bits + 1
+	for _, block := range FreeBlocks(network, subnets) {
+		ones, _ := block.Mask.Size()
+		if ones < largest {
+			largest = ones
+		}
+	}
+
+	fixedSet := NewCIDRSet(fixed)
+
+	for ones := networkOnes; ones < largest; ones++ {
+		mask := net.CIDRMask(ones, bits)
+
+		// Every block larger than the largest free block holds subnets, so
+		// only the blocks holding movable subnets need to be considered.
+		var candidates []net.IPNet
+		for _, subnet := range movable {
+			candidate := net.IPNet{IP: subnet.IP.Mask(mask), Mask: mask}
+			if !containsIPNet(candidates, candidate) {
+				candidates = append(candidates, candidate)
+			}
+		}
+		sort.Sort(ipNets(candidates))
+
+		var best []Move
+		for _, candidate := range candidates {
+			if fixedSet.Overlaps(NewCIDRSet([]net.IPNet{candidate})) {
+				continue
+			}
+
+			moves, ok := planMoves(network, candidate, movable, fixed)
+			if !ok {
+				continue
+			}
+			if best == nil || len(moves) < len(best) || (len(moves) == len(best) && movedAddresses(moves).Cmp(movedAddresses(best)) < 0) {
+				best = moves
+			}
+		}
+
+		if best != nil {
+			return best, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// PlanDefragmentation is like the PlanDefragmentation function, for the given
+// network, which must be one of the networks returned by Networks. Stored
+// subnets may be moved, except those delegated to child pools. Allocated,
+// excluded and the given reserved subnets must stay where they are. The
+// returned moves can be applied with MoveSubnet.
+func (s *Service) PlanDefragmentation(ctx context.Context, network net.IPNet, reserved []net.IPNet) ([]Move, error) {
+	networks, err := s.Networks(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if !containsIPNet(networks, network) {
+		return nil, microerror.Maskf(notFoundError, "network %#q is not a network of the pool", network.String())
+	}
+
+	storedSubnets, err := s.listSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	children, err := s.Children(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var movable []net.IPNet
+	for _, subnet := range storedSubnets {
+		if Contains(network, subnet) && !containsIPNet(children, subnet) {
+			movable = append(movable, subnet)
+		}
+	}
+
+	var fixed []net.IPNet
+	for _, subnet := range existingSubnets {
+		if !containsIPNet(movable, subnet) {
+			fixed = append(fixed, subnet)
+		}
+	}
+	fixed = append(fixed, reserved...)
+	fixed = append(fixed, s.allocatedSubnets...)
+	fixed = append(fixed, s.excludedSubnets([]net.IPNet{network})...)
+
+	moves, err := PlanDefragmentation(network, movable, fixed)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return moves, nil
+}
+
+// MoveSubnet moves the given stored subnet to the given subnet of the same
+// size, keeping its annotation, labels, lease, owner and dual-stack partner.
+// The new subnet must be contained by one of the networks returned by
+// Networks and aligned to its mask. An error matched by IsOverlap is returned
+// when it overlaps with stored, reserved, allocated or excluded subnets. An
+// error matched by IsInUse is returned when the subnet is delegated to a
+// child pool, or when addresses are allocated from it by a HostAllocator.
+func (s *Service) MoveSubnet(ctx context.Context, from, to net.IPNet, reserved []net.IPNet) error {
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("moving subnet %#q to %#q", from.String(), to.String()))
+	defer updateMetrics(s.pool, "move", time.Now())
+
+	if !bytes.Equal(from.Mask, to.Mask) {
+		return microerror.Maskf(invalidParameterError, "subnet %#q must be of the same size as %#q", to.String(), from.String())
+	}
+	if !to.IP.Equal(to.IP.Mask(to.Mask)) {
+		return microerror.Maskf(invalidParameterError, "subnet %#q is not aligned to its mask", to.String())
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	defer unlock()
+
+	k, err := microstorage.NewK(encodeKey(s.pool, from))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return microerror.Maskf(notFoundError, "subnet %#q", from.String())
+	} else if err != nil {
+		return microerror.Mask(err)
+	}
+
+	pool, err := s.searchChild(ctx, from)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if pool != "" {
+		return microerror.Maskf(inUseError, "subnet %#q is delegated to pool %#q", from.String(), pool)
+	}
+
+	hk, err := microstorage.NewK(encodeHostPrefix(s.pool, from))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	hosts, err := s.storage.List(ctx, hk)
+	if err != nil && !microstorage.IsNotFound(err) {
+		return microerror.Mask(err)
+	}
+	if len(hosts) > 0 {
+		return microerror.Maskf(inUseError, "subnet %#q has %d allocated addresses", from.String(), len(hosts))
+	}
+
+	networks, err := s.Networks(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	var contained bool
+	for _, network := range networks {
+		if Contains(network, to) {
+			contained = true
+			break
+		}
+	}
+	if !contained {
+		return microerror.Maskf(ipNotContainedError, "%v is not contained by any network of pool %#q", to.String(), s.pool)
+	}
+
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	var subnets []net.IPNet
+	subnets = append(subnets, existingSubnets...)
+	subnets = append(subnets, reserved...)
+	subnets = append(subnets, s.allocatedSubnets...)
+	subnets = append(subnets, s.excluded...)
+	for _, n := range subnets {
+		if overlaps(to, n) {
+			return microerror.Maskf(overlapError, "subnet %#q overlaps with subnet %#q", to.String(), n.String())
+		}
+	}
+
+	expires, err := s.searchExpiry(ctx, from)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	partner, err := s.searchPartner(ctx, from)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	owned, err := s.listOwnedSubnets(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	if err := s.checkLock(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+
+	// The new subnet is written before anything refers to it, and the old
+	// subnet is deleted after nothing refers to it anymore, so that a failure
+	// part way through leaves both subnets claimed, rather than neither.
+	if err := s.put(ctx, encodeKey(s.pool, to), kv.Val()); err != nil {
+		return microerror.Mask(err)
+	}
+	if !expires.IsZero() {
+		if err := s.putExpiry(ctx, to, expires); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+	if partner != nil {
+		if err := s.put(ctx, encodePairKey(s.pool, to), partner.String()); err != nil {
+			return microerror.Mask(err)
+		}
+		if err := s.put(ctx, encodePairKey(s.pool, *partner), to.String()); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+	for owner, ownedSubnet := range owned {
+		if ipNetEqual(ownedSubnet, from) {
+			if err := s.put(ctx, encodeOwnerKey(s.pool, owner), to.String()); err != nil {
+				return microerror.Mask(err)
+			}
+		}
+	}
+
+	if partner != nil {
+		if err := s.delete(ctx, encodePairKey(s.pool, from)); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+	if !expires.IsZero() {
+		if err := s.delete(ctx, encodeExpiryKey(s.pool, from)); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+	if err := s.delete(ctx, encodeKey(s.pool, from)); err != nil {
+		return microerror.Mask(err)
+	}
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("moved subnet %#q to %#q", from.String(), to.String()))
+
+	return nil
+}
+
+// planMoves returns the moves which free the given block of the given
+// network, by moving the movable subnets within it elsewhere. It returns false
+// when they do not fit elsewhere, or when a movable subnet is not within the
+// block but contains it. The subnets are placed largest first, each into the
+// smallest free block it fits, so that larger free blocks are kept intact.
+func planMoves(network, block net.IPNet, movable, fixed []net.IPNet) ([]Move, bool) {
+	var movers []net.IPNet
+	var staying []net.IPNet
+	for _, subnet := range movable {
+		switch {
+		case Contains(block, subnet):
+			movers = append(movers, subnet)
+		case overlaps(block, subnet):
+			return nil, false
+		default:
+			staying = append(staying, subnet)
+		}
+	}
+
+	sort.SliceStable(movers, func(i, j int) bool {
+		a, _ := movers[i].Mask.Size()
+		b, _ := movers[j].Mask.Size()
+		if a != b {
+			return a < b
+		}
+		return lessIPNet(movers[i], movers[j])
+	})
+
+	var taken []net.IPNet
+	taken = append(taken, staying...)
+	taken = append(taken, fixed...)
+	taken = append(taken, block)
+
+	free := NewCIDRSet([]net.IPNet{network}).Subtract(NewCIDRSet(taken))
+
+	var moves []Move
+	for _, mover := range movers {
+		ones, _ := mover.Mask.Size()
+
+		var dest *net.IPNet
+		destOnes := -1
+		for _, b := range free.CIDRs() {
+			bOnes, _ := b.Mask.Size()
+			if bOnes <= ones && bOnes > destOnes {
+				d := net.IPNet{IP: b.IP, Mask: mover.Mask}
+				dest = &d
+				destOnes = bOnes
+			}
+		}
+		if dest == nil {
+			return nil, false
+		}
+
+		free = free.Subtract(NewCIDRSet([]net.IPNet{*dest}))
+		moves = append(moves, Move{From: mover, To: *dest})
+	}
+
+	return moves, true
+}
+
+// movedAddresses returns the number of addresses moved by the given moves.
+func movedAddresses(moves []Move) *big.Int {
+	count := big.NewInt(0)
+	for _, m := range moves {
+		count.Add(count, size(m.From.Mask))
+	}
+
+	return count
+}
+
+// containsIPNet returns true when the given list contains the given network,
+// false otherwise.
+func containsIPNet(networks []net.IPNet, network net.IPNet) bool {
+	for _, n := range networks {
+		if ipNetEqual(n, network) {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,179 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestPlanDefragmentation tests the PlanDefragmentation function.
+func TestPlanDefragmentation(t *testing.T) {
+	testCases := []struct {
+		name          string
+		network       string
+		movable       []string
+		fixed         []string
+		expectedMoves []string
+		errorMatcher  func(error) bool
+	}{
+		{
+			name:          "case 0: free a /24, preferring the lower block",
+			network:       "10.4.0.0/23",
+			movable:       []string{"10.4.0.0/26", "10.4.1.128/26"},
+			expectedMoves: []string{"10.4.0.0/26 10.4.1.192/26"},
+		},
+		{
+			name:    "case 1: the largest free block can not be made larger",
+			network: "10.4.0.0/23",
+			movable: []string{"10.4.0.0/24"},
+		},
+		{
+			name:          "case 2: fixed subnets are not moved",
+			network:       "10.4.0.0/23",
+			movable:       []string{"10.4.1.128/26"},
+			fixed:         []string{"10.4.0.0/26"},
+			expectedMoves: []string{"10.4.1.128/26 10.4.0.64/26"},
+		},
+		{
+			name:          "case 3: the plan with the fewest moves is chosen",
+			network:       "10.4.0.0/22",
+			movable:       []string{"10.4.0.0/25", "10.4.0.128/25", "10.4.2.0/24"},
+			expectedMoves: []string{"10.4.2.0/24 10.4.1.0/24"},
+		},
+		{
+			name:          "case 4: larger subnets are placed first",
+			network:       "10.4.0.0/22",
+			movable:       []string{"10.4.0.0/26", "10.4.0.128/25", "10.4.2.0/24"},
+			fixed:         []string{"10.4.3.0/26"},
+			expectedMoves: []string{"10.4.0.128/25 10.4.3.128/25", "10.4.0.0/26 10.4.3.64/26"},
+		},
+		{
+			name:         "case 5: movable subnets must be within the network",
+			network:      "10.4.0.0/23",
+			movable:      []string{"10.5.0.0/26"},
+			errorMatcher: IsIPNotContained,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			moves, err := PlanDefragmentation(mustParseCIDR(tc.network), mustParseCIDRs(tc.movable), mustParseCIDRs(tc.fixed))
+
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.errorMatcher(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			var got []string
+			for _, m := range moves {
+				got = append(got, m.From.String()+" "+m.To.String())
+			}
+			if !reflect.DeepEqual(got, tc.expectedMoves) {
+				t.Fatalf("expected moves %v, got %v", tc.expectedMoves, got)
+			}
+		})
+	}
+}
+
+// TestMoveSubnet tests that a plan returned by Service.PlanDefragmentation can
+// be applied with Service.MoveSubnet, keeping what is stored for the subnets.
+func TestMoveSubnet(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/23")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	owned, err := service.CreateSubnetForOwner(ctx, "cluster-1", net.CIDRMask(26, 32), "workers", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	err = service.CreateSubnetWithCIDR(ctx, mustParseCIDR("10.4.1.128/26"), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	moves, err := service.PlanDefragmentation(ctx, network, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned planning defragmentation: %v", err)
+	}
+	if len(moves) != 1 || moves[0].From.String() != owned.String() || moves[0].To.String() != "10.4.1.192/26" {
+		t.Fatalf("unexpected moves %v", moves)
+	}
+
+	err = service.MoveSubnet(ctx, moves[0].From, moves[0].To, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned moving subnet: %v", err)
+	}
+
+	_, err = service.GetSubnet(ctx, owned)
+	if !IsNotFound(err) {
+		t.Fatalf("expected moved subnet to be deleted, got %v", err)
+	}
+	subnet, err := service.GetSubnet(ctx, moves[0].To)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting subnet: %v", err)
+	}
+	if subnet.Annotation != "workers" {
+		t.Fatalf("expected annotation to be kept, got %#q", subnet.Annotation)
+	}
+
+	again, err := service.CreateSubnetForOwner(ctx, "cluster-1", net.CIDRMask(26, 32), "workers", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if again.String() != moves[0].To.String() {
+		t.Fatalf("expected owner to be moved to %v, got %v", moves[0].To.String(), again.String())
+	}
+
+	blocks, err := service.FreeBlocks(ctx, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting free blocks: %v", err)
+	}
+	if len(blocks) != 2 || blocks[0].String() != "10.4.0.0/24" {
+		t.Fatalf("expected 10.4.0.0/24 to be free, got %v", blocks)
+	}
+
+	moves, err = service.PlanDefragmentation(ctx, network, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned planning defragmentation: %v", err)
+	}
+	if len(moves) != 0 {
+		t.Fatalf("expected no moves, got %v", moves)
+	}
+
+	err = service.MoveSubnet(ctx, mustParseCIDR("10.4.1.128/26"), mustParseCIDR("10.4.1.192/26"), nil)
+	if !IsOverlap(err) {
+		t.Fatalf("expected overlap error, got %v", err)
+	}
+	err = service.MoveSubnet(ctx, mustParseCIDR("10.4.1.128/26"), mustParseCIDR("10.4.0.0/25"), nil)
+	if !IsInvalidParameter(err) {
+		t.Fatalf("expected invalid parameter error, got %v", err)
+	}
+	err = service.MoveSubnet(ctx, mustParseCIDR("10.4.0.64/26"), mustParseCIDR("10.4.0.128/26"), nil)
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+}
@@ -0,0 +1,292 @@
+package ipam
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/microstorage"
+)
+
+// delegation is the value stored under the parent key of a child pool. It
+// identifies the pool and the subnet the child pool was delegated from.
+type delegation struct {
+	Pool    string `json:"pool"`
+	Network string `json:"network"`
+}
+
+// Delegate turns the given stored subnet into the network of the child pool
+// of the given name, and returns a service managing the child pool. The
+// delegation is stored, so that the child pool can be retrieved again with
+// Child, e.g. after a restart. DeleteSubnet refuses to delete the subnet while
+// the child pool holds subnets. Delegating a subnet to the same pool again
+// returns the child pool.
+func (s *Service) Delegate(ctx context.Context, subnet net.IPNet, pool string) (*Service, error) {
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("delegating subnet %#q to pool %#q", subnet.String(), pool))
+	defer updateMetrics(s.pool, "delegate", time.Now())
+
+	if pool == "" || strings.Contains(pool, "/") {
+		return nil, microerror.Maskf(invalidParameterError, "pool %#q must not be empty or contain slashes", pool)
+	}
+	if pool == s.pool {
+		return nil, microerror.Maskf(invalidParameterError, "pool %#q must not be delegated to itself", pool)
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	defer unlock()
+
+	_, err = s.GetSubnet(ctx, subnet)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	current, err := s.searchChild(ctx, subnet)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if current != "" && current != pool {
+		return nil, microerror.Maskf(invalidParameterError, "subnet %#q is already delegated to pool %#q", subnet.String(), current)
+	}
+
+	child, err := s.newChild(subnet, pool)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	existing, err := child.searchParent(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if existing != nil && *existing != *child.parent {
+		return nil, microerror.Maskf(invalidParameterError, "pool %#q is already delegated from subnet %#q of pool %#q", pool, existing.Network, existing.Pool)
+	}
+
+	// A pool which is not delegated yet must not hold any subnets, as they
+	// would not be tracked by this pool.
+	if existing == nil && current == "" {
+		claimed, err := child.listClaimedSubnets(ctx)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		if len(claimed) > 0 {
+			return nil, microerror.Maskf(inUseError, "pool %#q already holds subnets", pool)
+		}
+	}
+
+	// The child key is written before the parent key, so that the subnet is
+	// protected from deletion before the child pool can be used, see lock.
+	b, err := json.Marshal(child.parent)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if err := s.checkLock(ctx); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if err := s.put(ctx, encodeChildKey(s.pool, subnet), pool); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if err := s.put(ctx, poolKey(pool, ipamParentStorageKey), string(b)); err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("delegated subnet %#q to pool %#q", subnet.String(), pool))
+
+	return child, nil
+}
+
+// Child returns a service managing the child pool the given subnet was
+// delegated to by Delegate. An error matched by IsNotFound is returned when
+// the subnet is not delegated.
+func (s *Service) Child(ctx context.Context, subnet net.IPNet) (*Service, error) {
+	pool, err := s.searchChild(ctx, subnet)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if pool == "" {
+		return nil, microerror.Maskf(notFoundError, "subnet %#q is not delegated", subnet.String())
+	}
+
+	child, err := s.newChild(subnet, pool)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return child, nil
+}
+
+// Children returns the subnets delegated to child pools by Delegate, ordered
+// by network.
+func (s *Service) Children(ctx context.Context) ([]net.IPNet, error) {
+	k, err := microstorage.NewK(poolKey(s.pool, ipamChildStorageKey))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kvs, err := s.storage.List(ctx, k)
+	if err != nil && !microstorage.IsNotFound(err) {
+		return nil, microerror.Mask(err)
+	}
+
+	var children []net.IPNet
+	for _, kv := range kvs {
+		_, child, err := net.ParseCIDR(decodeKey(kv.Key()))
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		children = append(children, *child)
+	}
+
+	sort.Sort(ipNets(children))
+
+	return children, nil
+}
+
+// newChild returns a service managing the given pool, delegated from the
+// given subnet of this pool.
+func (s *Service) newChild(subnet net.IPNet, pool string) (*Service, error) {
+	child, err := New(Config{
+		Logger:  s.logger,
+		Storage: s.storage,
+
+		Pool:     pool,
+		Network:  &subnet,
+		Excluded: s.excluded,
+		Strategy: s.strategy,
+		Clock:    s.clock,
+		Profile:  s.profile.Name,
+
+		StorageLock: s.storageLock,
+	})
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	child.parent = &delegation{
+		Pool:    s.pool,
+		Network: subnet.String(),
+	}
+
+	return child, nil
+}
+
+// checkParent verifies that the delegation of a child pool has not been
+// deleted since the service was created. It returns nil for services not
+// created by Delegate or Child.
+func (s *Service) checkParent(ctx context.Context) error {
+	if s.parent == nil {
+		return nil
+	}
+
+	d, err := s.searchParent(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if d == nil || *d != *s.parent {
+		return microerror.Maskf(notFoundError, "delegation of pool %#q from subnet %#q has been deleted", s.pool, s.parent.Network)
+	}
+
+	return nil
+}
+
+// undelegate deletes the delegations of the given subnets. An error matched
+// by IsInUse is returned, and nothing is deleted, when any of the child pools
+// still holds subnets. The child pools are locked while they are checked, so
+// that they cannot allocate subnets in the meantime.
+func (s *Service) undelegate(ctx context.Context, subnets []net.IPNet) error {
+	var children []*Service
+	for _, subnet := range subnets {
+		pool, err := s.searchChild(ctx, subnet)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		if pool == "" {
+			continue
+		}
+
+		child, err := s.newChild(subnet, pool)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		// The delegation may have been deleted partially by a previous
+		// call, which must not prevent deleting the rest.
+		child.parent = nil
+
+		unlock, err := child.lock(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		defer unlock()
+
+		claimed, err := child.listClaimedSubnets(ctx)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		if len(claimed) > 0 {
+			return microerror.Maskf(inUseError, "subnet %#q is delegated to pool %#q, which holds %d subnets", subnet.String(), pool, len(claimed))
+		}
+
+		children = append(children, child)
+	}
+
+	// The parent key is deleted before the child key, so that the child pool
+	// cannot be used anymore before the subnet loses its protection.
+	for _, child := range children {
+		if err := child.checkLock(ctx); err != nil {
+			return microerror.Mask(err)
+		}
+		if err := s.delete(ctx, poolKey(child.pool, ipamParentStorageKey)); err != nil {
+			return microerror.Mask(err)
+		}
+		if err := s.delete(ctx, encodeChildKey(s.pool, child.network)); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+
+	return nil
+}
+
+// searchChild returns the name of the child pool the given subnet is
+// delegated to, or an empty string if it is not delegated.
+func (s *Service) searchChild(ctx context.Context, subnet net.IPNet) (string, error) {
+	k, err := microstorage.NewK(encodeChildKey(s.pool, subnet))
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return "", nil
+	} else if err != nil {
+		return "", microerror.Mask(err)
+	}
+
+	return kv.Val(), nil
+}
+
+// searchParent returns the delegation of this pool, or nil if it is not a
+// child pool.
+func (s *Service) searchParent(ctx context.Context) (*delegation, error) {
+	k, err := microstorage.NewK(poolKey(s.pool, ipamParentStorageKey))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var d delegation
+	err = json.Unmarshal([]byte(kv.Val()), &d)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return &d, nil
+}
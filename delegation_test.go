@@ -0,0 +1,295 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestDelegate tests that subnets delegated to child pools are protected from
+// deletion while the child pools hold subnets.
+func TestDelegate(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.0.0.0/8")
+
+	parent, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	region, err := parent.CreateSubnet(ctx, net.CIDRMask(16, 32), "region-eu", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	child, err := parent.Delegate(ctx, region, "region-eu")
+	if err != nil {
+		t.Fatalf("unexpected error returned delegating subnet: %v", err)
+	}
+
+	cluster, err := child.CreateSubnet(ctx, net.CIDRMask(24, 32), "cluster-1", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !Contains(region, cluster) {
+		t.Fatalf("subnet %v not contained by delegated subnet %v", cluster.String(), region.String())
+	}
+
+	err = parent.DeleteSubnet(ctx, region)
+	if !IsInUse(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+
+	// The delegation survives restarts.
+	restarted, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	children, err := restarted.Children(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing children: %v", err)
+	}
+	if len(children) != 1 || !ipNetEqual(children[0], region) {
+		t.Fatalf("children == %v, want [%v]", children, region.String())
+	}
+
+	child, err = restarted.Child(ctx, region)
+	if err != nil {
+		t.Fatalf("unexpected error returned retrieving child: %v", err)
+	}
+	subnets, err := child.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 1 || !ipNetEqual(subnets[0].Network, cluster) {
+		t.Fatalf("subnets == %v, want [%v]", subnets, cluster.String())
+	}
+
+	err = child.DeleteSubnet(ctx, cluster)
+	if err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+	err = restarted.DeleteSubnet(ctx, region)
+	if err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+
+	// The child pool cannot allocate anymore once the delegation is deleted.
+	_, err = child.CreateSubnet(ctx, net.CIDRMask(24, 32), "cluster-2", nil)
+	if !IsNotFound(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+	_, err = restarted.Child(ctx, region)
+	if !IsNotFound(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+}
+
+// TestDelegateInvalid tests that Delegate refuses invalid delegations.
+func TestDelegateInvalid(t *testing.T) {
+	tests := []struct {
+		name                 string
+		subnet               net.IPNet
+		pool                 string
+		expectedErrorHandler func(error) bool
+	}{
+		{
+			name:                 "case 0: delegate a subnet that is not stored",
+			subnet:               mustParseCIDR("10.9.0.0/16"),
+			pool:                 "region-us",
+			expectedErrorHandler: IsNotFound,
+		},
+		{
+			name:                 "case 1: delegate to an empty pool name",
+			subnet:               mustParseCIDR("10.1.0.0/16"),
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 2: delegate a subnet delegated to another pool",
+			subnet:               mustParseCIDR("10.0.0.0/16"),
+			pool:                 "region-us",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 3: delegate to a pool delegated from another subnet",
+			subnet:               mustParseCIDR("10.1.0.0/16"),
+			pool:                 "region-eu",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 4: delegate to a pool holding subnets",
+			subnet:               mustParseCIDR("10.1.0.0/16"),
+			pool:                 "infra",
+			expectedErrorHandler: IsInUse,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			storage, err := memory.New(memory.Config{})
+			if err != nil {
+				t.Fatalf("error creating new storage: %v", err)
+			}
+
+			network := mustParseCIDR("10.0.0.0/8")
+
+			parent, err := New(Config{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+				Network: &network,
+			})
+			if err != nil {
+				t.Fatalf("error returned creating ipam service: %v", err)
+			}
+
+			for _, n := range []string{"10.0.0.0/16", "10.1.0.0/16"} {
+				err := parent.CreateSubnetWithCIDR(ctx, mustParseCIDR(n), "", nil)
+				if err != nil {
+					t.Fatalf("unexpected error returned creating subnet: %v", err)
+				}
+			}
+			_, err = parent.Delegate(ctx, mustParseCIDR("10.0.0.0/16"), "region-eu")
+			if err != nil {
+				t.Fatalf("unexpected error returned delegating subnet: %v", err)
+			}
+
+			infraNetwork := mustParseCIDR("192.168.0.0/16")
+			infra, err := New(Config{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+				Pool:    "infra",
+				Network: &infraNetwork,
+			})
+			if err != nil {
+				t.Fatalf("error returned creating ipam service: %v", err)
+			}
+			_, err = infra.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+			if err != nil {
+				t.Fatalf("unexpected error returned creating subnet: %v", err)
+			}
+
+			_, err = parent.Delegate(ctx, tc.subnet, tc.pool)
+			if !tc.expectedErrorHandler(err) {
+				t.Fatalf("error == %#v, want matching", err)
+			}
+		})
+	}
+}
+
+// TestDelegateConcurrentDelete tests that a subnet deleted while it is being
+// delegated never leaves a child pool behind delegated from a free subnet.
+func TestDelegateConcurrentDelete(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.0.0.0/8")
+
+	// Delegate is stalled right before writing the delegation, after it has
+	// checked that the subnet is stored, while DeleteSubnet is called.
+	stalled := &stallingStorage{
+		Storage: storage,
+		key:     strings.TrimPrefix(ipamChildStorageKey, "/"),
+		stalled: make(chan struct{}),
+	}
+
+	parent, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: stalled,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	subnet, err := parent.CreateSubnet(ctx, net.CIDRMask(16, 32), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	delegated := make(chan error)
+	go func() {
+		_, err := parent.Delegate(ctx, subnet, "child")
+		delegated <- err
+	}()
+
+	<-stalled.stalled
+	err = parent.DeleteSubnet(ctx, subnet)
+	if err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+	err = <-delegated
+	if err != nil {
+		t.Fatalf("unexpected error returned delegating subnet: %v", err)
+	}
+
+	// The delegation has been written first, so the subnet is deleted along
+	// with it.
+	_, err = parent.GetSubnet(ctx, subnet)
+	if !IsNotFound(err) {
+		t.Fatalf("expected subnet %v to be deleted, got %v", subnet.String(), err)
+	}
+	_, err = parent.Child(ctx, subnet)
+	if !IsNotFound(err) {
+		t.Fatalf("expected subnet %v not to be delegated, got %v", subnet.String(), err)
+	}
+	k, err := microstorage.NewK(poolKey("child", ipamParentStorageKey))
+	if err != nil {
+		t.Fatalf("unexpected error creating key: %v", err)
+	}
+	exists, err := storage.Exists(ctx, k)
+	if err != nil {
+		t.Fatalf("unexpected error checking key: %v", err)
+	}
+	if exists {
+		t.Fatalf("expected delegation of pool %#q to be deleted", "child")
+	}
+}
+
+// stallingStorage is a storage which stalls the first write of a key
+// containing the given key, after closing stalled.
+type stallingStorage struct {
+	microstorage.Storage
+
+	key     string
+	stalled chan struct{}
+	once    sync.Once
+}
+
+func (s *stallingStorage) Put(ctx context.Context, kv microstorage.KV) error {
+	if strings.Contains(kv.Key(), s.key) {
+		s.once.Do(func() {
+			close(s.stalled)
+			time.Sleep(50 * time.Millisecond)
+		})
+	}
+
+	return s.Storage.Put(ctx, kv)
+}
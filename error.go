@@ -22,6 +22,15 @@ func IsIncorrectNumberOfFreeRanges(err error) bool {
 	return microerror.Cause(err) == incorrectNumberOfFreeRangesError
 }
 
+var inUseError = &microerror.Error{
+	Kind: "inUseError",
+}
+
+// IsInUse asserts inUseError.
+func IsInUse(err error) bool {
+	return microerror.Cause(err) == inUseError
+}
+
 var invalidConfigError = &microerror.Error{
 	Kind: "invalidConfigError",
 }
@@ -49,6 +58,15 @@ func IsIPNotContained(err error) bool {
 	return microerror.Cause(err) == ipNotContainedError
 }
 
+var lockLostError = &microerror.Error{
+	Kind: "lockLostError",
+}
+
+// IsLockLost asserts lockLostError.
+func IsLockLost(err error) bool {
+	return microerror.Cause(err) == lockLostError
+}
+
 var maskIncorrectSizeError = &microerror.Error{
 	Kind: "maskIncorrectSizeError",
 }
@@ -72,10 +90,32 @@ var nilIPError = &microerror.Error{
 }
 
 // IsNilIP asserts nilIPError.
+//
+// Deprecated: FreeInNetworks reports a nil IP returned by a strategy as an
+// error matched by IsSpaceExhausted, so IsNilIP never matches errors
+// returned by this package.
 func IsNilIP(err error) bool {
 	return microerror.Cause(err) == nilIPError
 }
 
+var notFoundError = &microerror.Error{
+	Kind: "notFoundError",
+}
+
+// IsNotFound asserts notFoundError.
+func IsNotFound(err error) bool {
+	return microerror.Cause(err) == notFoundError
+}
+
+var overlapError = &microerror.Error{
+	Kind: "overlapError",
+}
+
+// IsOverlap asserts overlapError.
+func IsOverlap(err error) bool {
+	return microerror.Cause(err) == overlapError
+}
+
 var spaceExhaustedError = &microerror.Error{
 	Kind: "spaceExhaustedError",
 }
@@ -0,0 +1,158 @@
+package ipam
+
+import (
+	"context"
+	"math/big"
+	"net"
+
+	"github.com/giantswarm/microerror"
+)
+
+// ForecastResult is the outcome of a single simulated allocation, see
+// Forecast.
+type ForecastResult struct {
+	Mask net.IPMask
+	// Fits is true when the allocation would succeed.
+	Fits bool
+	// Subnet is the subnet which would be allocated. It is empty when the
+	// allocation would fail.
+	Subnet net.IPNet
+}
+
+// Capacity returns the number of subnets of the given mask which can still be
+// allocated from the given network, given the allocated subnets. The free
+// space is counted in aligned blocks, so fragmentation is taken into account.
+func Capacity(network net.IPNet, allocated []net.IPNet, mask net.IPMask) (*big.Int, error) {
+	if len(network.Mask) != len(mask) {
+		return nil, microerror.Maskf(maskIncorrectSizeError, "network mask %v and requested mask %v are of different address families", network.Mask, mask)
+	}
+
+	ones, _ := mask.Size()
+
+	count := big.NewInt(0)
+	for _, block := range FreeBlocks(network, allocated) {
+		blockOnes, _ := block.Mask.Size()
+		if blockOnes > ones {
+			continue
+		}
+		count.Add(count, new(big.Int).Div(size(block.Mask), size(mask)))
+	}
+
+	return count, nil
+}
+
+// Forecast simulates allocating subnets of the given masks, in the given
+// order, from the given network, as chosen by the given strategy. The given
+// subnets are already allocated. It returns the outcome of each allocation,
+// in the order of the masks. Allocations which would fail do not take up
+// space, so that later, smaller, allocations may still succeed. A nil
+// strategy behaves like FirstFit. Note that simulating RandomFit draws from
+// its random source, like real allocations do. Forecasts with RandomFit are
+// only an estimate, as real allocations pick other positions, which fragment
+// the free space differently, so that both the subnets and whether later
+// allocations fit may differ.
+func Forecast(network net.IPNet, allocated []net.IPNet, masks []net.IPMask, strategy Strategy) ([]ForecastResult, error) {
+	subnets := CanonicalizeSubnets(network, append([]net.IPNet(nil), allocated...))
+
+	results, err := forecast([]net.IPNet{network}, subnets, masks, strategy)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return results, nil
+}
+
+// Forecast is like the Forecast function, but simulates allocations from the
+// networks returned by Networks, with the configured strategy. Stored,
+// allocated, excluded and the given reserved subnets are taken into account.
+// Nothing is stored. RandomFit is simulated with a separately seeded random
+// source, so that forecasts do not change which subnets are allocated later
+// on. Forecasts with RandomFit are therefore only an estimate, see the
+// Forecast function.
+func (s *Service) Forecast(ctx context.Context, masks []net.IPMask, reserved []net.IPNet) ([]ForecastResult, error) {
+	attached, err := s.listAttachedNetworks(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var subnets []net.IPNet
+	subnets = append(subnets, existingSubnets...)
+	subnets = append(subnets, reserved...)
+	subnets = append(subnets, s.allocatedSubnets...)
+
+	// Each mask is allocated from the networks of its address family.
+	families := map[int][]net.IPNet{
+		ipLength(s.network.IP): s.expandNetwork(s.network, attached),
+	}
+	if s.ipv6Network != nil {
+		families[ipLength(s.ipv6Network.IP)] = s.expandNetwork(*s.ipv6Network, attached)
+	}
+
+	canonicalized := map[int][]net.IPNet{}
+	for length, networks := range families {
+		for _, network := range networks {
+			c := append([]net.IPNet(nil), subnets...)
+			canonicalized[length] = append(canonicalized[length], CanonicalizeSubnets(network, c)...)
+		}
+		canonicalized[length] = append(canonicalized[length], s.excludedSubnets(networks)...)
+	}
+
+	strategy := s.strategy
+	if _, ok := strategy.(*RandomFit); ok {
+		strategy = &RandomFit{}
+	}
+
+	var results []ForecastResult
+	for _, mask := range masks {
+		length := len(mask)
+
+		networks, ok := families[length]
+		if !ok {
+			return nil, microerror.Maskf(maskIncorrectSizeError, "no network of the address family of mask %v", mask)
+		}
+
+		r, err := forecast(networks, canonicalized[length], []net.IPMask{mask}, strategy)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		if r[0].Fits {
+			canonicalized[length] = append(canonicalized[length], r[0].Subnet)
+		}
+
+		results = append(results, r[0])
+	}
+
+	return results, nil
+}
+
+// forecast simulates allocating subnets of the given masks from the given
+// networks. The given subnets must be contained by the networks.
+func forecast(networks []net.IPNet, subnets []net.IPNet, masks []net.IPMask, strategy Strategy) ([]ForecastResult, error) {
+	subnets = append([]net.IPNet(nil), subnets...)
+
+	var results []ForecastResult
+	for _, mask := range masks {
+		result := ForecastResult{
+			Mask: mask,
+		}
+
+		subnet, err := FreeInNetworks(networks, mask, subnets, strategy)
+		if IsSpaceExhausted(err) || IsMaskTooBig(err) {
+			// The allocation would fail.
+		} else if err != nil {
+			return nil, microerror.Mask(err)
+		} else {
+			result.Fits = true
+			result.Subnet = subnet
+			subnets = append(subnets, subnet)
+		}
+
+		results = append(results, result)
+	}
+
+	return results, nil
+}
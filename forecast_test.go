@@ -0,0 +1,281 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestCapacity tests the Capacity function.
+func TestCapacity(t *testing.T) {
+	tests := []struct {
+		network          string
+		allocated        []string
+		mask             int
+		expectedCapacity string
+	}{
+		{
+			network:          "10.4.0.0/16",
+			mask:             24,
+			expectedCapacity: "256",
+		},
+		{
+			network:          "10.4.0.0/22",
+			allocated:        []string{"10.4.1.0/24", "10.4.3.0/25"},
+			mask:             24,
+			expectedCapacity: "2",
+		},
+		// Fragmented: plenty of free addresses, but no free /24.
+		{
+			network:          "10.4.0.0/23",
+			allocated:        []string{"10.4.0.0/26", "10.4.0.128/26", "10.4.1.0/26", "10.4.1.128/26"},
+			mask:             24,
+			expectedCapacity: "0",
+		},
+		{
+			network:          "10.4.0.0/23",
+			allocated:        []string{"10.4.0.0/26", "10.4.0.128/26", "10.4.1.0/26", "10.4.1.128/26"},
+			mask:             26,
+			expectedCapacity: "4",
+		},
+		{
+			network:          "fd00::/48",
+			allocated:        []string{"fd00::/64"},
+			mask:             64,
+			expectedCapacity: "65535",
+		},
+	}
+
+	for index, test := range tests {
+		network := mustParseCIDR(test.network)
+
+		capacity, err := Capacity(network, mustParseCIDRs(test.allocated), net.CIDRMask(test.mask, len(network.Mask)*8))
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned: %v", index, err)
+		}
+		if capacity.String() != test.expectedCapacity {
+			t.Fatalf("%v: expected capacity %v, got %v", index, test.expectedCapacity, capacity)
+		}
+	}
+}
+
+// TestForecast tests the Forecast function.
+func TestForecast(t *testing.T) {
+	testCases := []struct {
+		name            string
+		network         string
+		allocated       []string
+		masks           []int
+		strategy        Strategy
+		expectedSubnets []string
+		errorMatcher    func(error) bool
+	}{
+		{
+			name:            "case 0: all requests fit",
+			network:         "10.4.0.0/22",
+			masks:           []int{24, 24, 23},
+			expectedSubnets: []string{"10.4.0.0/24", "10.4.1.0/24", "10.4.2.0/23"},
+		},
+		{
+			name:            "case 1: failing requests do not take up space",
+			network:         "10.4.0.0/22",
+			allocated:       []string{"10.4.0.0/24"},
+			masks:           []int{24, 22, 23, 24, 24},
+			expectedSubnets: []string{"10.4.1.0/24", "", "10.4.2.0/23", "", ""},
+		},
+		{
+			name:            "case 2: fragmentation is taken into account",
+			network:         "10.4.0.0/23",
+			allocated:       []string{"10.4.0.0/26", "10.4.1.128/26"},
+			masks:           []int{24, 25, 25, 25},
+			expectedSubnets: []string{"", "10.4.0.128/25", "10.4.1.0/25", ""},
+		},
+		{
+			name:            "case 3: the strategy is used",
+			network:         "10.4.0.0/22",
+			allocated:       []string{"10.4.1.0/24"},
+			masks:           []int{24, 24},
+			strategy:        LastFit{},
+			expectedSubnets: []string{"10.4.3.0/24", "10.4.2.0/24"},
+		},
+		{
+			name:         "case 4: a mask of a different address family is rejected",
+			network:      "10.4.0.0/22",
+			masks:        []int{64},
+			errorMatcher: IsMaskIncorrectSize,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			network := mustParseCIDR(tc.network)
+
+			var masks []net.IPMask
+			for _, m := range tc.masks {
+				bits := 32
+				if m > 32 {
+					bits = 128
+				}
+				masks = append(masks, net.CIDRMask(m, bits))
+			}
+
+			allocated := mustParseCIDRs(tc.allocated)
+			results, err := Forecast(network, allocated, masks, tc.strategy)
+
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.errorMatcher(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.errorMatcher != nil {
+				return
+			}
+
+			if len(results) != len(tc.expectedSubnets) {
+				t.Fatalf("expected %v results, got %v", len(tc.expectedSubnets), len(results))
+			}
+			for i, r := range results {
+				if r.Fits != (tc.expectedSubnets[i] != "") {
+					t.Fatalf("result %v: expected fits %v, got %v", i, tc.expectedSubnets[i] != "", r.Fits)
+				}
+				if r.Fits && r.Subnet.String() != tc.expectedSubnets[i] {
+					t.Fatalf("result %v: expected subnet %v, got %v", i, tc.expectedSubnets[i], r.Subnet.String())
+				}
+			}
+
+			// The allocated subnets must not be modified.
+			if len(allocated) != len(tc.allocated) {
+				t.Fatalf("expected allocated subnets to be unmodified, got %v", allocated)
+			}
+		})
+	}
+}
+
+// TestServiceForecast tests that Service.Forecast simulates allocations from
+// every network of the pool, without storing any subnet.
+func TestServiceForecast(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/23")
+	ipv6Network := mustParseCIDR("fd00::/62")
+
+	service, err := New(Config{
+		Logger:           microloggertest.New(),
+		Storage:          storage,
+		Network:          &network,
+		IPv6Network:      &ipv6Network,
+		AllocatedSubnets: []net.IPNet{mustParseCIDR("10.4.1.0/25")},
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	err = service.AddNetwork(ctx, mustParseCIDR("10.8.0.0/24"))
+	if err != nil {
+		t.Fatalf("unexpected error returned adding network: %v", err)
+	}
+	_, err = service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	masks := []net.IPMask{
+		net.CIDRMask(24, 32),
+		net.CIDRMask(64, 128),
+		net.CIDRMask(25, 32),
+		net.CIDRMask(25, 32),
+		net.CIDRMask(25, 32),
+	}
+	reserved := []net.IPNet{mustParseCIDR("10.8.0.128/25")}
+
+	results, err := service.Forecast(ctx, masks, reserved)
+	if err != nil {
+		t.Fatalf("unexpected error returned forecasting: %v", err)
+	}
+
+	expected := []string{"", "fd00::/64", "10.4.1.128/25", "10.8.0.0/25", ""}
+	if len(results) != len(expected) {
+		t.Fatalf("expected %v results, got %v", len(expected), len(results))
+	}
+	for i, r := range results {
+		if r.Fits != (expected[i] != "") {
+			t.Fatalf("result %v: expected fits %v, got %v", i, expected[i] != "", r.Fits)
+		}
+		if r.Fits && r.Subnet.String() != expected[i] {
+			t.Fatalf("result %v: expected subnet %v, got %v", i, expected[i], r.Subnet.String())
+		}
+	}
+
+	subnets, err := service.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 1 {
+		t.Fatalf("expected forecasting to store nothing, got %v subnets", len(subnets))
+	}
+}
+
+// TestServiceForecastRandomFit tests that forecasts do not change which
+// subnets are allocated by a service using RandomFit.
+func TestServiceForecastRandomFit(t *testing.T) {
+	ctx := context.Background()
+
+	network := mustParseCIDR("10.4.0.0/16")
+	mask := net.CIDRMask(24, 32)
+
+	allocate := func(forecasts int) []net.IPNet {
+		storage, err := memory.New(memory.Config{})
+		if err != nil {
+			t.Fatalf("error creating new storage: %v", err)
+		}
+
+		service, err := New(Config{
+			Logger:   microloggertest.New(),
+			Storage:  storage,
+			Network:  &network,
+			Strategy: NewRandomFit(42),
+		})
+		if err != nil {
+			t.Fatalf("error returned creating ipam service: %v", err)
+		}
+
+		var subnets []net.IPNet
+		for i := 0; i < 4; i++ {
+			for j := 0; j < forecasts; j++ {
+				_, err := service.Forecast(ctx, []net.IPMask{mask, mask}, nil)
+				if err != nil {
+					t.Fatalf("unexpected error returned forecasting: %v", err)
+				}
+			}
+
+			subnet, err := service.CreateSubnet(ctx, mask, "", nil)
+			if err != nil {
+				t.Fatalf("unexpected error returned creating subnet: %v", err)
+			}
+			subnets = append(subnets, subnet)
+		}
+
+		return subnets
+	}
+
+	expected := allocate(0)
+	subnets := allocate(3)
+	if !reflect.DeepEqual(cidrStrings(subnets), cidrStrings(expected)) {
+		t.Fatalf("expected %v, got %v", cidrStrings(expected), cidrStrings(subnets))
+	}
+}
@@ -0,0 +1,275 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/micrologger"
+	"github.com/giantswarm/microstorage"
+)
+
+// HostAllocatorConfig represents the configuration used to create a new host
+// allocator.
+type HostAllocatorConfig struct {
+	Logger  micrologger.Logger
+	Storage microstorage.Storage
+
+	// Pool is the name of the pool the subnet belongs to, see Config.Pool.
+	// Allocations are serialised with those of the pool.
+	Pool string
+	// Subnet is the subnet from which addresses are allocated, e.g. one
+	// returned by Service.CreateSubnet. It must be stored in the pool.
+	Subnet *net.IPNet
+	// Reserved is a list of addresses, contained by `Subnet`, which are never
+	// allocated, e.g. the address of the gateway.
+	Reserved []net.IP
+	// Profile is the name of the profile deciding which addresses of
+	// `Subnet` are usable, see LookupProfile. Defaults to plain.
+	Profile string
+	// StorageLock serialises allocations across processes sharing the same
+	// storage, see Config.StorageLock.
+	StorageLock bool
+}
+
+// NewHostAllocator creates a new configured host allocator.
+func NewHostAllocator(config HostAllocatorConfig) (*HostAllocator, error) {
+	if config.Logger == nil {
+		return nil, microerror.Maskf(invalidConfigError, "logger must not be empty")
+	}
+	if config.Storage == nil {
+		return nil, microerror.Maskf(invalidConfigError, "storage must not be empty")
+	}
+
+	if config.Subnet == nil {
+		return nil, microerror.Maskf(invalidConfigError, "subnet must not be empty")
+	}
+	subnet := *config.Subnet
+	subnet.IP = subnet.IP.Mask(subnet.Mask)
+	if subnet.IP == nil {
+		return nil, microerror.Maskf(invalidConfigError, "subnet (%v) must be a valid network", config.Subnet.String())
+	}
+	for _, ip := range config.Reserved {
+		if !subnet.Contains(ip) {
+			return nil, microerror.Maskf(
+				invalidConfigError,
+				"reserved address (%v) must be contained by subnet (%v)",
+				ip.String(),
+				subnet.String(),
+			)
+		}
+	}
+
+	profile, err := LookupProfile(config.Profile)
+	if IsNotFound(err) {
+		return nil, microerror.Maskf(invalidConfigError, "profile %#q is unknown", config.Profile)
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	// The service is only used to serialise allocations, see Service.lock.
+	service, err := New(Config{
+		Logger:  config.Logger,
+		Storage: config.Storage,
+
+		Pool:    config.Pool,
+		Network: &subnet,
+
+		StorageLock: config.StorageLock,
+	})
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	newHostAllocator := &HostAllocator{
+		logger:  config.Logger,
+		storage: config.Storage,
+
+		pool:     config.Pool,
+		subnet:   subnet,
+		reserved: config.Reserved,
+		profile:  profile,
+		service:  service,
+	}
+
+	return newHostAllocator, nil
+}
+
+// HostAllocator allocates single addresses from a subnet. Only the addresses
+// usable according to the configured profile are allocated. By default, the
+// network address and, for IPv4 subnets, the broadcast address are never
+// allocated, unless the subnet is too small to have them. The allocated
+// addresses are stored under their own storage keys, per subnet.
+type HostAllocator struct {
+	logger  micrologger.Logger
+	storage microstorage.Storage
+
+	pool     string
+	subnet   net.IPNet
+	reserved []net.IP
+	profile  Profile
+	service  *Service
+}
+
+// Allocate stores and returns the lowest available address of the subnet,
+// with the given annotation. An error matched by IsSpaceExhausted is returned
+// when all usable addresses are allocated or reserved. An error matched by
+// IsNotFound is returned when the subnet is not stored in the pool, e.g.
+// because it has been deleted.
+func (h *HostAllocator) Allocate(ctx context.Context, annotation string) (net.IP, error) {
+	h.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("allocating address from subnet %#q", h.subnet.String()))
+	defer updateMetrics(h.pool, "allocate_host", time.Now())
+
+	unlock, err := h.service.lock(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	defer unlock()
+
+	// The subnet may have been deleted, along with its addresses, since the
+	// allocator was created, see Service.DeleteSubnet.
+	_, err = h.service.GetSubnet(ctx, h.subnet)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	hosts, err := h.List(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	taken := map[string]bool{}
+	for _, host := range hosts {
+		taken[host.IP.String()] = true
+	}
+	for _, ip := range h.reserved {
+		taken[ip.String()] = true
+	}
+
+	start, end, ok := h.profile.UsableRange(h.subnet)
+	if !ok {
+		return nil, microerror.Maskf(spaceExhaustedError, "subnet %#q has no usable addresses in profile %#q", h.subnet.String(), h.profile.Name)
+	}
+
+	var ip net.IP
+	for candidate := start; ; candidate = add(candidate, 1) {
+		if !taken[candidate.String()] {
+			ip = candidate
+			break
+		}
+		if candidate.Equal(end) {
+			return nil, microerror.Maskf(spaceExhaustedError, "all addresses of subnet %#q are allocated", h.subnet.String())
+		}
+	}
+
+	if err := h.service.checkLock(ctx); err != nil {
+		return nil, microerror.Mask(err)
+	}
+	if err := h.service.put(ctx, encodeHostKey(h.pool, h.subnet, ip), annotation); err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	h.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("allocated address %#q from subnet %#q", ip.String(), h.subnet.String()))
+
+	return ip, nil
+}
+
+// List returns the allocated addresses, along with their annotations, ordered
+// by address.
+func (h *HostAllocator) List(ctx context.Context) ([]Host, error) {
+	k, err := microstorage.NewK(encodeHostPrefix(h.pool, h.subnet))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kvs, err := h.storage.List(ctx, k)
+	if err != nil && !microstorage.IsNotFound(err) {
+		return nil, microerror.Mask(err)
+	}
+
+	hosts := []Host{}
+	for _, kv := range kvs {
+		ip := net.ParseIP(decodeHostKey(kv.Key()))
+		if ip == nil {
+			return nil, microerror.Maskf(invalidParameterError, "storage key %#q is not an address", kv.Key())
+		}
+		hosts = append(hosts, Host{
+			IP:         ip,
+			Annotation: kv.Val(),
+		})
+	}
+
+	sort.Slice(hosts, func(i, j int) bool {
+		return compareIP(hosts[i].IP, hosts[j].IP) < 0
+	})
+
+	return hosts, nil
+}
+
+// Release deletes the given address from storage, meaning it can be allocated
+// again. An error matched by IsNotFound is returned when the address is not
+// allocated.
+func (h *HostAllocator) Release(ctx context.Context, ip net.IP) error {
+	h.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("releasing address %#q", ip.String()))
+	defer updateMetrics(h.pool, "release_host", time.Now())
+
+	unlock, err := h.service.lock(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	defer unlock()
+
+	k, err := microstorage.NewK(encodeHostKey(h.pool, h.subnet, ip))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	exists, err := h.storage.Exists(ctx, k)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if !exists {
+		return microerror.Maskf(notFoundError, "address %#q", ip.String())
+	}
+
+	if err := h.service.checkLock(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := h.service.delete(ctx, encodeHostKey(h.pool, h.subnet, ip)); err != nil {
+		return microerror.Mask(err)
+	}
+
+	h.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("released address %#q", ip.String()))
+
+	return nil
+}
+
+// deleteHosts removes the addresses allocated from the given subnets by host
+// allocators.
+func (s *Service) deleteHosts(ctx context.Context, subnets []net.IPNet) error {
+	for _, subnet := range subnets {
+		k, err := microstorage.NewK(encodeHostPrefix(s.pool, subnet))
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		kvs, err := s.storage.List(ctx, k)
+		if microstorage.IsNotFound(err) {
+			continue
+		} else if err != nil {
+			return microerror.Mask(err)
+		}
+
+		for _, kv := range kvs {
+			ip := net.ParseIP(decodeHostKey(kv.Key()))
+			if ip == nil {
+				continue
+			}
+			if err := s.delete(ctx, encodeHostKey(s.pool, subnet, ip)); err != nil {
+				return microerror.Mask(err)
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,236 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestHostAllocator tests that addresses are allocated in order, skipping the
+// network, broadcast and reserved addresses, and can be allocated again once
+// released.
+func TestHostAllocator(t *testing.T) {
+	tests := []struct {
+		subnet            string
+		reserved          []string
+		expectedAddresses []string
+	}{
+		{
+			subnet:            "10.4.0.0/29",
+			expectedAddresses: []string{"10.4.0.1", "10.4.0.2", "10.4.0.3", "10.4.0.4", "10.4.0.5", "10.4.0.6"},
+		},
+		{
+			subnet:            "10.4.0.0/29",
+			reserved:          []string{"10.4.0.1", "10.4.0.3"},
+			expectedAddresses: []string{"10.4.0.2", "10.4.0.4", "10.4.0.5", "10.4.0.6"},
+		},
+		// Point-to-point subnets use both addresses.
+		{
+			subnet:            "10.4.0.8/31",
+			expectedAddresses: []string{"10.4.0.8", "10.4.0.9"},
+		},
+		{
+			subnet:            "10.4.0.8/32",
+			expectedAddresses: []string{"10.4.0.8"},
+		},
+		// IPv6 subnets have no broadcast address.
+		{
+			subnet:            "fd00::/126",
+			expectedAddresses: []string{"fd00::1", "fd00::2", "fd00::3"},
+		},
+	}
+
+	for index, test := range tests {
+		ctx := context.Background()
+
+		storage, err := memory.New(memory.Config{})
+		if err != nil {
+			t.Fatalf("%v: error creating new storage: %v", index, err)
+		}
+
+		subnet := mustParseCIDR(test.subnet)
+
+		service, err := New(Config{
+			Logger:  microloggertest.New(),
+			Storage: storage,
+			Network: &subnet,
+		})
+		if err != nil {
+			t.Fatalf("%v: error returned creating ipam service: %v", index, err)
+		}
+		err = service.CreateSubnetWithCIDR(ctx, subnet, "", nil)
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned creating subnet: %v", index, err)
+		}
+
+		var reserved []net.IP
+		for _, r := range test.reserved {
+			reserved = append(reserved, net.ParseIP(r))
+		}
+
+		allocator, err := NewHostAllocator(HostAllocatorConfig{
+			Logger:   microloggertest.New(),
+			Storage:  storage,
+			Subnet:   &subnet,
+			Reserved: reserved,
+		})
+		if err != nil {
+			t.Fatalf("%v: error returned creating host allocator: %v", index, err)
+		}
+
+		for _, expected := range test.expectedAddresses {
+			ip, err := allocator.Allocate(ctx, "node")
+			if err != nil {
+				t.Fatalf("%v: unexpected error returned allocating address: %v", index, err)
+			}
+			if ip.String() != expected {
+				t.Fatalf("%v: expected address %v, got %v", index, expected, ip.String())
+			}
+		}
+
+		_, err = allocator.Allocate(ctx, "node")
+		if !IsSpaceExhausted(err) {
+			t.Fatalf("%v: expected space exhausted error, got %v", index, err)
+		}
+
+		released := net.ParseIP(test.expectedAddresses[0])
+		err = allocator.Release(ctx, released)
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned releasing address: %v", index, err)
+		}
+		err = allocator.Release(ctx, released)
+		if !IsNotFound(err) {
+			t.Fatalf("%v: expected not found error, got %v", index, err)
+		}
+
+		ip, err := allocator.Allocate(ctx, "node")
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned allocating address: %v", index, err)
+		}
+		if !ip.Equal(released) {
+			t.Fatalf("%v: expected released address %v to be allocated again, got %v", index, released, ip)
+		}
+
+		hosts, err := allocator.List(ctx)
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned listing addresses: %v", index, err)
+		}
+		if len(hosts) != len(test.expectedAddresses) {
+			t.Fatalf("%v: expected %v addresses, got %v", index, len(test.expectedAddresses), len(hosts))
+		}
+		for i, host := range hosts {
+			if host.IP.String() != test.expectedAddresses[i] || host.Annotation != "node" {
+				t.Fatalf("%v: unexpected address %v with annotation %#q", index, host.IP, host.Annotation)
+			}
+		}
+	}
+}
+
+// TestHostAllocatorSubnets tests that the addresses of different subnets, and
+// the subnets of the pool, are stored apart, and that addresses are released
+// along with their subnet.
+func TestHostAllocatorSubnets(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	var allocators []*HostAllocator
+	for i := 0; i < 2; i++ {
+		subnet, err := service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error returned creating subnet: %v", err)
+		}
+
+		allocator, err := NewHostAllocator(HostAllocatorConfig{
+			Logger:   microloggertest.New(),
+			Storage:  storage,
+			Subnet:   &subnet,
+			Reserved: []net.IP{add(subnet.IP, 1)},
+		})
+		if err != nil {
+			t.Fatalf("error returned creating host allocator: %v", err)
+		}
+		allocators = append(allocators, allocator)
+	}
+
+	for i, expected := range []string{"10.4.0.2", "10.4.1.2"} {
+		ip, err := allocators[i].Allocate(ctx, "")
+		if err != nil {
+			t.Fatalf("unexpected error returned allocating address: %v", err)
+		}
+		if ip.String() != expected {
+			t.Fatalf("expected address %v, got %v", expected, ip.String())
+		}
+	}
+
+	subnets, err := service.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 2 {
+		t.Fatalf("expected 2 subnets, got %v", len(subnets))
+	}
+
+	// Deleting a subnet releases its addresses, and moving it is refused
+	// while it has any.
+	err = service.MoveSubnet(ctx, mustParseCIDR("10.4.1.0/24"), mustParseCIDR("10.4.2.0/24"), nil)
+	if !IsInUse(err) {
+		t.Fatalf("expected in use error, got %v", err)
+	}
+	err = service.DeleteSubnet(ctx, mustParseCIDR("10.4.0.0/24"))
+	if err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+	hosts, err := allocators[0].List(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing addresses: %v", err)
+	}
+	if len(hosts) != 0 {
+		t.Fatalf("expected addresses of deleted subnet to be released, got %v", hosts)
+	}
+	_, err = allocators[0].Allocate(ctx, "")
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error allocating from deleted subnet, got %v", err)
+	}
+	hosts, err = allocators[0].List(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing addresses: %v", err)
+	}
+	if len(hosts) != 0 {
+		t.Fatalf("expected no addresses of deleted subnet, got %v", hosts)
+	}
+	hosts, err = allocators[1].List(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing addresses: %v", err)
+	}
+	if len(hosts) != 1 {
+		t.Fatalf("expected addresses of other subnet to be kept, got %v", hosts)
+	}
+
+	_, err = NewHostAllocator(HostAllocatorConfig{
+		Logger:   microloggertest.New(),
+		Storage:  storage,
+		Subnet:   &network,
+		Reserved: []net.IP{net.ParseIP("10.5.0.1")},
+	})
+	if !IsInvalidConfig(err) {
+		t.Fatalf("expected invalid config error, got %v", err)
+	}
+}
@@ -3,8 +3,7 @@ package ipam
 
 import (
 	"bytes"
-	"encoding/binary"
-	"math"
+	"math/big"
 	"math/bits"
 	"net"
 	"reflect"
@@ -75,19 +74,75 @@ func Contains(network, subnet net.IPNet) bool {
 	return network.Contains(subnetRange.start) && network.Contains(subnetRange.end)
 }
 
+// ipNetEqual returns true if the given IPNets refer to the same network.
+func ipNetEqual(a, b net.IPNet) bool {
+	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
+}
+
+// overlaps returns true when the two networks share at least one address,
+// false otherwise.
+func overlaps(a, b net.IPNet) bool {
+	return a.Contains(b.IP) || b.Contains(a.IP)
+}
+
 // Free takes a network, a mask, and a list of subnets.
 // An available network, within the first network, is returned.
 func Free(network net.IPNet, mask net.IPMask, subnets []net.IPNet) (net.IPNet, error) {
-	if size(network.Mask) < size(mask) {
+	freeNetwork, err := FreeWithStrategy(network, mask, subnets, FirstFit{})
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	return freeNetwork, nil
+}
+
+// FreeWithStrategy is like Free, but the given strategy decides where within
+// the free space of the network the returned network is placed. A nil
+// strategy behaves like FirstFit.
+func FreeWithStrategy(network net.IPNet, mask net.IPMask, subnets []net.IPNet, strategy Strategy) (net.IPNet, error) {
+	freeNetwork, err := FreeInNetworks([]net.IPNet{network}, mask, subnets, strategy)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	return freeNetwork, nil
+}
+
+// FreeInNetworks is like FreeWithStrategy, but takes several networks, which
+// must not overlap, and treats them as one. The free space of the networks is
+// searched in the given order. Each subnet must be contained by one of the
+// networks.
+func FreeInNetworks(networks []net.IPNet, mask net.IPMask, subnets []net.IPNet, strategy Strategy) (net.IPNet, error) {
+	if strategy == nil {
+		strategy = FirstFit{}
+	}
+	if len(networks) == 0 {
+		return net.IPNet{}, microerror.Maskf(invalidParameterError, "networks must not be empty")
+	}
+
+	maskOnes, maskBits := mask.Size()
+	var fits bool
+	for _, network := range networks {
+		networkOnes, networkBits := network.Mask.Size()
+		if networkBits != maskBits {
+			return net.IPNet{}, microerror.Maskf(
+				maskIncorrectSizeError, "network mask %v and requested mask %v are of different address families", network.Mask, mask,
+			)
+		}
+		if networkOnes <= maskOnes {
+			fits = true
+		}
+	}
+	if !fits {
 		return net.IPNet{}, microerror.Maskf(
-			maskTooBigError, "have: %v, requested: %v", network.Mask, mask,
+			maskTooBigError, "have: %v, requested: %v", networks[0].Mask, mask,
 		)
 	}
 
 	for _, subnet := range subnets {
-		if !network.Contains(subnet.IP) {
+		if !containedByAny(networks, subnet.IP) {
 			return net.IPNet{}, microerror.Maskf(
-				ipNotContainedError, "%v is not contained by %v", subnet.IP, network,
+				ipNotContainedError, "%v is not contained by %v", subnet.IP, networks[0],
 			)
 		}
 	}
@@ -95,29 +150,46 @@ func Free(network net.IPNet, mask net.IPMask, subnets []net.IPNet) (net.IPNet, e
 	sort.Sort(ipNets(subnets))
 
 	// Find all the free IP ranges.
-	freeIPRanges, err := freeIPRanges(network, subnets)
+	freeIPRanges, err := freeIPRangesInNetworks(networks, subnets)
 	if err != nil {
 		return net.IPNet{}, microerror.Mask(err)
 	}
 
 	// Attempt to find a free space, of the required size.
-	freeIP, err := space(freeIPRanges, mask)
+	freeIP, err := strategy.Space(fromIPRanges(freeIPRanges), mask)
 	if err != nil {
 		return net.IPNet{}, microerror.Mask(err)
 	}
 
-	// Invariant: The IP of the network returned should not be nil.
+	// Strategies outside of this package return a nil IP when there is no
+	// free space, see Strategy.Space.
 	if freeIP == nil {
-		return net.IPNet{}, microerror.Mask(nilIPError)
+		return net.IPNet{}, microerror.Maskf(spaceExhaustedError, "tried to fit: %v", mask)
 	}
 
 	freeNetwork := net.IPNet{IP: freeIP, Mask: mask}
 
+	// Invariant: The network returned should be aligned to its mask, and
+	// not overlap with any of the subnets. Strategies may be implemented
+	// outside of this package.
+	if !freeNetwork.IP.Equal(freeNetwork.IP.Mask(mask)) {
+		return net.IPNet{}, microerror.Maskf(
+			invalidParameterError, "strategy returned %v, which is not aligned to its mask", freeNetwork.String(),
+		)
+	}
+	for _, subnet := range subnets {
+		if overlaps(freeNetwork, subnet) {
+			return net.IPNet{}, microerror.Maskf(
+				overlapError, "strategy returned %v, which overlaps with %v", freeNetwork.String(), subnet.String(),
+			)
+		}
+	}
+
 	// Invariant: The IP of the network returned should be contained
-	// within the network supplied.
-	if !network.Contains(freeNetwork.IP) {
+	// within one of the networks supplied.
+	if !containedByAny(networks, freeNetwork.IP) {
 		return net.IPNet{}, microerror.Maskf(
-			ipNotContainedError, "%v is not contained by %v", freeNetwork.IP, network,
+			ipNotContainedError, "%v is not contained by %v", freeNetwork.IP, networks[0],
 		)
 	}
 
@@ -132,6 +204,17 @@ func Free(network net.IPNet, mask net.IPMask, subnets []net.IPNet) (net.IPNet, e
 	return freeNetwork, nil
 }
 
+// FreeBlocks takes a network, and a list of allocated subnets. It returns the
+// free space of the network, i.e. all addresses not within any of the
+// allocated subnets, as the minimal sorted list of networks. Allocated
+// subnets may overlap each other, and the network only partially.
+// e.g: 10.4.0.0/22, [10.4.1.0/24] -> [10.4.0.0/24, 10.4.2.0/23]
+func FreeBlocks(network net.IPNet, allocated []net.IPNet) []net.IPNet {
+	free := NewCIDRSet([]net.IPNet{network}).Subtract(NewCIDRSet(allocated))
+
+	return free.CIDRs()
+}
+
 // Half takes a network and returns two subnets which split the network in
 // half.
 func Half(network net.IPNet) (first, second net.IPNet, err error) {
@@ -179,17 +262,71 @@ func Split(network net.IPNet, n uint) ([]net.IPNet, error) {
 	return subnets, nil
 }
 
+// SplitVariable returns subnets of the given masks from network, in the order
+// of the masks. The subnets are packed largest first, each aligned to its
+// mask, so that they fit whenever the network has room for them. An error
+// matched by IsSpaceExhausted is returned when they do not fit.
+//
+// Example:
+//	  network: 10.0.0.0/19
+//	  masks: [/26, /20, /24]
+//	  returned: [10.0.17.0/26, 10.0.0.0/20, 10.0.16.0/24]
+//
+func SplitVariable(network net.IPNet, masks []net.IPMask) ([]net.IPNet, error) {
+	order := make([]int, len(masks))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, _ := masks[order[i]].Size()
+		b, _ := masks[order[j]].Size()
+		return a < b
+	})
+
+	networkOnes, _ := network.Mask.Size()
+
+	subnets := make([]net.IPNet, len(masks))
+	var allocated []net.IPNet
+	for _, i := range order {
+		// A mask larger than the network never fits, which is reported like
+		// any other subnet which does not fit.
+		ones, _ := masks[i].Size()
+		if len(masks[i]) == len(network.Mask) && ones < networkOnes {
+			return nil, microerror.Maskf(spaceExhaustedError, "tried to fit: %v", masks[i])
+		}
+
+		subnet, err := Free(network, masks[i], allocated)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		subnets[i] = subnet
+		allocated = append(allocated, subnet)
+	}
+
+	return subnets, nil
+}
+
 // add increments the given IP by the number.
 // e.g: add(10.0.4.0, 1) -> 10.0.4.1.
-// Negative values are allowed for decrementing.
+// Negative values are allowed for decrementing. The result wraps around
+// within the address family of the given IP.
 func add(ip net.IP, number int) net.IP {
-	return decimalToIP(ipToDecimal(ip) + number)
+	decimal := ipToDecimal(ip)
+	decimal.Add(decimal, big.NewInt(int64(number)))
+
+	return decimalToIP(decimal, ipLength(ip))
 }
 
-// decimalToIP converts an int to a net.IP.
-func decimalToIP(ip int) net.IP {
-	t := make(net.IP, 4)
-	binary.BigEndian.PutUint32(t, uint32(ip))
+// decimalToIP converts a big.Int to a net.IP of the given length in bytes,
+// i.e. net.IPv4len or net.IPv6len. Values outside of the address space are
+// wrapped around.
+func decimalToIP(decimal *big.Int, length int) net.IP {
+	space := new(big.Int).Lsh(big.NewInt(1), uint(length*8))
+	b := new(big.Int).Mod(decimal, space).Bytes()
+
+	t := make(net.IP, length)
+	copy(t[length-len(b):], b)
 
 	return t
 }
@@ -255,7 +392,7 @@ func freeIPRanges(network net.IPNet, subnets []net.IPNet) ([]ipRange, error) {
 			nextSubnetRange := newIPRange(subnets[i+1])
 
 			// If the two subnets are not contiguous,
-			if ipToDecimal(currentSubnetRange.end)+1 != ipToDecimal(nextSubnetRange.start) {
+			if !add(currentSubnetRange.end, 1).Equal(nextSubnetRange.start) {
 				// Then there is a free range between them.
 				start := add(currentSubnetRange.end, 1)
 				end := add(nextSubnetRange.start, -1)
@@ -282,35 +419,100 @@ func freeIPRanges(network net.IPNet, subnets []net.IPNet) ([]ipRange, error) {
 	return freeSubnets, nil
 }
 
-// ipToDecimal converts a net.IP to an int.
-func ipToDecimal(ip net.IP) int {
+// freeIPRangesInNetworks takes a list of networks, and a sorted list of
+// subnets, each contained by one of the networks. It calculates available
+// IPRanges within all networks, in the order of the networks.
+func freeIPRangesInNetworks(networks []net.IPNet, subnets []net.IPNet) ([]ipRange, error) {
+	freeSubnets := []ipRange{}
+
+	for _, network := range networks {
+		var contained []net.IPNet
+		for _, subnet := range subnets {
+			if network.Contains(subnet.IP) {
+				contained = append(contained, subnet)
+			}
+		}
+
+		ranges, err := freeIPRanges(network, contained)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		freeSubnets = append(freeSubnets, ranges...)
+	}
+
+	return freeSubnets, nil
+}
+
+// containedByAny returns true if the given IP is contained by any of the
+// given networks, false otherwise.
+func containedByAny(networks []net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// compareIP returns -1, 0 or +1 depending on whether the IP a is lower than,
+// equal to or higher than the IP b. IPv4 addresses are lower than all IPv6
+// addresses.
+func compareIP(a, b net.IP) int {
+	if ipLength(a) != ipLength(b) {
+		if ipLength(a) < ipLength(b) {
+			return -1
+		}
+		return 1
+	}
+
+	return ipToDecimal(a).Cmp(ipToDecimal(b))
+}
+
+// ipLength returns the length in bytes of the address family the given IP
+// belongs to. IPv4 addresses in their 16 byte form are treated as IPv4.
+func ipLength(ip net.IP) int {
+	if ip.To4() != nil {
+		return net.IPv4len
+	}
+
+	return net.IPv6len
+}
+
+// ipToDecimal converts a net.IP to a big.Int.
+func ipToDecimal(ip net.IP) *big.Int {
 	t := ip
-	if len(ip) == 16 {
-		t = ip[12:16]
+	if v4 := ip.To4(); v4 != nil {
+		t = v4
 	}
 
-	return int(binary.BigEndian.Uint32(t))
+	return new(big.Int).SetBytes(t)
 }
 
 // newIPRange takes an IPNet, and returns the ipRange of the network.
 func newIPRange(network net.IPNet) ipRange {
 	start := network.IP
-	end := add(network.IP, size(network.Mask)-1)
 
-	return ipRange{start: start, end: end}
+	end := ipToDecimal(network.IP)
+	end.Add(end, size(network.Mask))
+	end.Sub(end, big.NewInt(1))
+
+	return ipRange{start: start, end: decimalToIP(end, ipLength(network.IP))}
 }
 
 // size takes a mask, and returns the number of addresses.
-func size(mask net.IPMask) int {
-	ones, _ := mask.Size()
-	size := int(math.Pow(2, float64(32-ones)))
+func size(mask net.IPMask) *big.Int {
+	ones, bits := mask.Size()
 
-	return size
+	return new(big.Int).Lsh(big.NewInt(1), uint(bits-ones))
 }
 
 // space takes a list of free ip ranges, and a mask,
 // and returns the start IP of the first range that could fit the mask.
 func space(freeIPRanges []ipRange, mask net.IPMask) (net.IP, error) {
+	_, maskBits := mask.Size()
+	maskSize := size(mask)
+
 	for _, freeIPRange := range freeIPRanges {
 		start := ipToDecimal(freeIPRange.start)
 		end := ipToDecimal(freeIPRange.end)
@@ -324,21 +526,17 @@ func space(freeIPRanges []ipRange, mask net.IPMask) (net.IP, error) {
 		//          We look for next available /24 network so first suitable
 		//          start IP for this would be 10.1.3.0.
 		//
-		ones, _ := mask.Size()
-		trailingZeros := bits.TrailingZeros32(uint32(start))
-		for (start < end) && (ones < (32 - trailingZeros)) {
-			var mask uint32
-			for i := 0; i < trailingZeros; i++ {
-				mask |= 1 << uint32(i)
-			}
-
-			start = int(uint32(start) | mask)
-			start++
-			trailingZeros = bits.TrailingZeros32(uint32(start))
+		remainder := new(big.Int).Mod(start, maskSize)
+		if remainder.Sign() != 0 {
+			start.Add(start, maskSize)
+			start.Sub(start, remainder)
 		}
 
-		if end-start+1 >= size(mask) {
-			return decimalToIP(start), nil
+		last := new(big.Int).Add(start, maskSize)
+		last.Sub(last, big.NewInt(1))
+
+		if last.Cmp(end) <= 0 {
+			return decimalToIP(start, maskBits/8), nil
 		}
 	}
 
@@ -3,6 +3,7 @@ package ipam
 import (
 	"bytes"
 	"fmt"
+	"math/big"
 	"net"
 	"reflect"
 	"sort"
@@ -80,6 +81,30 @@ func TestAdd(t *testing.T) {
 			number:     1,
 			expectedIP: "0.0.0.0",
 		},
+
+		{
+			ip:         "fd00::",
+			number:     1,
+			expectedIP: "fd00::1",
+		},
+
+		{
+			ip:         "fd00::",
+			number:     -1,
+			expectedIP: "fcff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+		},
+
+		{
+			ip:         "fd00::ffff:ffff",
+			number:     1,
+			expectedIP: "fd00::1:0:0",
+		},
+
+		{
+			ip:         "::",
+			number:     -1,
+			expectedIP: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+		},
 	}
 
 	for index, test := range tests {
@@ -459,35 +484,70 @@ func Test_CanonicalizeSubnets(t *testing.T) {
 // TestDecimalToIP tests the decimalToIP function.
 func TestDecimalToIP(t *testing.T) {
 	tests := []struct {
-		decimal    int
+		decimal    string
+		length     int
 		expectedIP string
 	}{
 		{
-			decimal:    0,
+			decimal:    "0",
+			length:     net.IPv4len,
 			expectedIP: "0.0.0.0",
 		},
 		{
-			decimal:    1283,
+			decimal:    "1283",
+			length:     net.IPv4len,
 			expectedIP: "0.0.5.3",
 		},
 		{
-			decimal:    167772160,
+			decimal:    "167772160",
+			length:     net.IPv4len,
 			expectedIP: "10.0.0.0",
 		},
 		{
-			decimal:    168034304,
+			decimal:    "168034304",
+			length:     net.IPv4len,
 			expectedIP: "10.4.0.0",
 		},
 		{
-			decimal:    4294967295,
+			decimal:    "4294967295",
+			length:     net.IPv4len,
 			expectedIP: "255.255.255.255",
 		},
+		{
+			decimal:    "0",
+			length:     net.IPv6len,
+			expectedIP: "::",
+		},
+		{
+			decimal:    "4294967296",
+			length:     net.IPv6len,
+			expectedIP: "::1:0:0",
+		},
+		{
+			decimal:    "336294682933583715844663186250927177728",
+			length:     net.IPv6len,
+			expectedIP: "fd00::",
+		},
+		{
+			decimal:    "340282366920938463463374607431768211455",
+			length:     net.IPv6len,
+			expectedIP: "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+		},
 	}
 
 	for index, test := range tests {
-		returnedIP := decimalToIP(test.decimal)
+		decimal, ok := new(big.Int).SetString(test.decimal, 10)
+		if !ok {
+			t.Fatalf("%v: could not parse decimal: %v", index, test.decimal)
+		}
+
+		returnedIP := decimalToIP(decimal, test.length)
 		expectedIP := net.ParseIP(test.expectedIP)
 
+		if len(returnedIP) != test.length {
+			t.Fatalf("%v: unexpected ip length returned.\nexpected: %v, returned: %v", index, test.length, len(returnedIP))
+		}
+
 		if !returnedIP.Equal(expectedIP) {
 			t.Fatalf(
 				"%v: unexpected decimal returned.\nexpected: %v, returned: %v",
@@ -649,6 +709,63 @@ func TestFree(t *testing.T) {
 			expectedErrorHandler: IsIPNotContained,
 		},
 
+		// Test that an IPv6 network with no existing subnets returns the correct subnet.
+		{
+			network:         "fd00::/48",
+			mask:            64,
+			subnets:         []string{},
+			expectedNetwork: "fd00::/64",
+		},
+
+		// Test that an IPv6 network with two existing subnets returns the correct subnet.
+		{
+			network:         "fd00::/48",
+			mask:            64,
+			subnets:         []string{"fd00::/64", "fd00:0:0:1::/64"},
+			expectedNetwork: "fd00:0:0:2::/64",
+		},
+
+		// Test that an IPv6 network with an existing subnet, that is fragmented,
+		// but can't fit the requested network size before, returns the correct subnet.
+		{
+			network:         "fd00::/48",
+			mask:            63,
+			subnets:         []string{"fd00:0:0:1::/64"},
+			expectedNetwork: "fd00:0:0:2::/63",
+		},
+
+		// Test that a single address can be allocated from an IPv6 network.
+		{
+			network:         "fd00::/120",
+			mask:            128,
+			subnets:         []string{"fd00::/128"},
+			expectedNetwork: "fd00::1/128",
+		},
+
+		// Test that allocating from the top of the IPv6 address space works.
+		{
+			network:         "ffff:ffff:ffff:ffff::/64",
+			mask:            65,
+			subnets:         []string{"ffff:ffff:ffff:ffff::/65"},
+			expectedNetwork: "ffff:ffff:ffff:ffff:8000::/65",
+		},
+
+		// Test where the IPv6 range is full.
+		{
+			network:              "fd00::/48",
+			mask:                 49,
+			subnets:              []string{"fd00::/49", "fd00:0:0:8000::/49"},
+			expectedErrorHandler: IsSpaceExhausted,
+		},
+
+		// Test a setup where a network larger than the main IPv6 network is requested.
+		{
+			network:              "fd00::/48",
+			mask:                 47,
+			subnets:              []string{},
+			expectedErrorHandler: IsMaskTooBig,
+		},
+
 		{
 			network: "10.1.0.0/16",
 			mask:    24,
@@ -857,7 +974,8 @@ func TestFree(t *testing.T) {
 			t.Fatalf("%v: could not parse cidr: %v", index, test.network)
 		}
 
-		mask := net.CIDRMask(test.mask, 32)
+		_, bits := network.Mask.Size()
+		mask := net.CIDRMask(test.mask, bits)
 
 		subnets := []net.IPNet{}
 		for _, e := range test.subnets {
@@ -899,6 +1017,206 @@ func TestFree(t *testing.T) {
 				)
 			}
 		}
+
+		// The other strategies place the network elsewhere, but must fail
+		// in the same cases, and otherwise return a valid network.
+		strategies := []Strategy{BestFit{}, LastFit{}, NewRandomFit(int64(index))}
+		for _, strategy := range strategies {
+			returnedNetwork, err := FreeWithStrategy(*network, mask, subnets, strategy)
+
+			if err != nil {
+				if test.expectedErrorHandler == nil {
+					t.Fatalf("%v: %T: unexpected error returned.\nreturned: %v", index, strategy, err)
+				}
+				if !test.expectedErrorHandler(err) {
+					t.Fatalf("%v: %T: incorrect error returned.\nreturned: %v", index, strategy, err)
+				}
+				continue
+			}
+			if test.expectedErrorHandler != nil {
+				t.Fatalf("%v: %T: expected error not returned.", index, strategy)
+			}
+
+			if !Contains(*network, returnedNetwork) {
+				t.Fatalf("%v: %T: returned network %s not contained by %s", index, strategy, returnedNetwork.String(), network.String())
+			}
+			if !returnedNetwork.IP.Equal(returnedNetwork.IP.Mask(mask)) || !bytes.Equal(returnedNetwork.Mask, mask) {
+				t.Fatalf("%v: %T: returned network %s not aligned to mask %s", index, strategy, returnedNetwork.String(), mask.String())
+			}
+			for _, subnet := range subnets {
+				if overlaps(returnedNetwork, subnet) {
+					t.Fatalf("%v: %T: returned network %s overlaps %s", index, strategy, returnedNetwork.String(), subnet.String())
+				}
+			}
+		}
+	}
+}
+
+// TestFreeBlocks tests the FreeBlocks function.
+func TestFreeBlocks(t *testing.T) {
+	tests := []struct {
+		network        string
+		allocated      []string
+		expectedBlocks []string
+	}{
+		{
+			network:        "10.4.0.0/16",
+			expectedBlocks: []string{"10.4.0.0/16"},
+		},
+		{
+			network:        "10.4.0.0/22",
+			allocated:      []string{"10.4.1.0/24"},
+			expectedBlocks: []string{"10.4.0.0/24", "10.4.2.0/23"},
+		},
+		{
+			network:        "10.4.0.0/22",
+			allocated:      []string{"10.4.0.0/24", "10.4.0.0/25", "10.4.3.0/24"},
+			expectedBlocks: []string{"10.4.1.0/24", "10.4.2.0/24"},
+		},
+		{
+			network:        "10.4.0.0/24",
+			allocated:      []string{"10.4.0.64/26", "10.4.0.192/27"},
+			expectedBlocks: []string{"10.4.0.0/26", "10.4.0.128/26", "10.4.0.224/27"},
+		},
+		// Allocated subnets outside of the network are ignored, and those
+		// partially overlapping it are clipped.
+		{
+			network:        "10.4.0.0/24",
+			allocated:      []string{"10.5.0.0/16", "10.4.0.0/23"},
+			expectedBlocks: []string{},
+		},
+		{
+			network:        "fd00::/64",
+			allocated:      []string{"fd00::/65"},
+			expectedBlocks: []string{"fd00::8000:0:0:0/65"},
+		},
+	}
+
+	for index, test := range tests {
+		blocks := FreeBlocks(mustParseCIDR(test.network), mustParseCIDRs(test.allocated))
+
+		if !reflect.DeepEqual(cidrStrings(blocks), test.expectedBlocks) {
+			t.Fatalf("%v: expected %v, got %v", index, test.expectedBlocks, cidrStrings(blocks))
+		}
+	}
+}
+
+// TestFreeInNetworks tests the FreeInNetworks function.
+func TestFreeInNetworks(t *testing.T) {
+	tests := []struct {
+		name                 string
+		networks             []string
+		mask                 net.IPMask
+		subnets              []string
+		strategy             Strategy
+		expectedNetwork      string
+		expectedErrorHandler func(error) bool
+	}{
+		{
+			name:            "case 0: allocate from the first network",
+			networks:        []string{"10.4.0.0/16", "10.8.0.0/16"},
+			mask:            net.CIDRMask(24, 32),
+			expectedNetwork: "10.4.0.0/24",
+		},
+		{
+			name:            "case 1: allocate from the second network when the first is full",
+			networks:        []string{"10.4.0.0/16", "10.8.0.0/16"},
+			mask:            net.CIDRMask(24, 32),
+			subnets:         []string{"10.4.0.0/16"},
+			expectedNetwork: "10.8.0.0/24",
+		},
+		{
+			name:            "case 2: networks are searched in the given order",
+			networks:        []string{"10.8.0.0/16", "10.4.0.0/16"},
+			mask:            net.CIDRMask(24, 32),
+			subnets:         []string{"10.8.0.0/24"},
+			expectedNetwork: "10.8.1.0/24",
+		},
+		{
+			name:            "case 3: skip networks smaller than the mask",
+			networks:        []string{"10.4.0.0/24", "10.8.0.0/16"},
+			mask:            net.CIDRMask(20, 32),
+			expectedNetwork: "10.8.0.0/20",
+		},
+		{
+			name:            "case 4: last fit allocates from the top of the last network",
+			networks:        []string{"10.4.0.0/16", "10.8.0.0/16"},
+			mask:            net.CIDRMask(24, 32),
+			strategy:        LastFit{},
+			expectedNetwork: "10.8.255.0/24",
+		},
+		{
+			name:            "case 5: ipv6 networks",
+			networks:        []string{"fd00::/64", "fd01::/64"},
+			mask:            net.CIDRMask(65, 128),
+			subnets:         []string{"fd00::/65", "fd00:0:0:0:8000::/65"},
+			expectedNetwork: "fd01::/65",
+		},
+		{
+			name:                 "case 6: all networks are full",
+			networks:             []string{"10.4.0.0/24", "10.8.0.0/24"},
+			mask:                 net.CIDRMask(24, 32),
+			subnets:              []string{"10.4.0.0/24", "10.8.0.0/24"},
+			expectedErrorHandler: IsSpaceExhausted,
+		},
+		{
+			name:                 "case 7: mask larger than all networks",
+			networks:             []string{"10.4.0.0/24", "10.8.0.0/24"},
+			mask:                 net.CIDRMask(16, 32),
+			expectedErrorHandler: IsMaskTooBig,
+		},
+		{
+			name:                 "case 8: subnet outside of all networks",
+			networks:             []string{"10.4.0.0/16", "10.8.0.0/16"},
+			mask:                 net.CIDRMask(24, 32),
+			subnets:              []string{"10.6.0.0/24"},
+			expectedErrorHandler: IsIPNotContained,
+		},
+		{
+			name:                 "case 9: networks of different address families",
+			networks:             []string{"10.4.0.0/16", "fd00::/64"},
+			mask:                 net.CIDRMask(24, 32),
+			expectedErrorHandler: IsMaskIncorrectSize,
+		},
+		{
+			name:                 "case 10: no networks",
+			mask:                 net.CIDRMask(24, 32),
+			expectedErrorHandler: IsInvalidParameter,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var networks []net.IPNet
+			for _, n := range tc.networks {
+				networks = append(networks, mustParseCIDR(n))
+			}
+			var subnets []net.IPNet
+			for _, n := range tc.subnets {
+				subnets = append(subnets, mustParseCIDR(n))
+			}
+
+			network, err := FreeInNetworks(networks, tc.mask, subnets, tc.strategy)
+
+			switch {
+			case err == nil && tc.expectedErrorHandler == nil:
+				// correct; carry on
+			case err != nil && tc.expectedErrorHandler == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.expectedErrorHandler != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.expectedErrorHandler(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.expectedErrorHandler != nil {
+				return
+			}
+
+			if network.String() != tc.expectedNetwork {
+				t.Fatalf("network == %v, want %v", network.String(), tc.expectedNetwork)
+			}
+		})
 	}
 }
 
@@ -1020,6 +1338,30 @@ func TestFreeIPRanges(t *testing.T) {
 				},
 			},
 		},
+
+		// Test that given an IPv6 network, and two fragmented subnets,
+		// the three remaining free ranges are returned as free.
+		{
+			network: "fd00::/48",
+			subnets: []string{
+				"fd00:0:0:1::/64",
+				"fd00:0:0:3::/64",
+			},
+			expectedFreeIPRanges: []ipRange{
+				{
+					start: net.ParseIP("fd00::"),
+					end:   net.ParseIP("fd00::ffff:ffff:ffff:ffff"),
+				},
+				{
+					start: net.ParseIP("fd00:0:0:2::"),
+					end:   net.ParseIP("fd00:0:0:2:ffff:ffff:ffff:ffff"),
+				},
+				{
+					start: net.ParseIP("fd00:0:0:4::"),
+					end:   net.ParseIP("fd00:0:0:ffff:ffff:ffff:ffff:ffff"),
+				},
+			},
+		},
 	}
 
 	for index, test := range tests {
@@ -1092,6 +1434,27 @@ func TestHalf(t *testing.T) {
 			ExpectedSecond:       "10.4.0.1/32",
 			ExpectedErrorMatcher: nil,
 		},
+		// Test 3.
+		{
+			Network:              "fd00::/48",
+			ExpectedFirst:        "fd00::/49",
+			ExpectedSecond:       "fd00:0:0:8000::/49",
+			ExpectedErrorMatcher: nil,
+		},
+		// Test 4.
+		{
+			Network:              "fd00::/127",
+			ExpectedFirst:        "fd00::/128",
+			ExpectedSecond:       "fd00::1/128",
+			ExpectedErrorMatcher: nil,
+		},
+		// Test 5.
+		{
+			Network:              "fd00::/128",
+			ExpectedFirst:        "<nil>",
+			ExpectedSecond:       "<nil>",
+			ExpectedErrorMatcher: IsMaskTooBig,
+		},
 	}
 
 	for i, tc := range tests {
@@ -1122,38 +1485,50 @@ func TestHalf(t *testing.T) {
 func TestIPToDecimal(t *testing.T) {
 	tests := []struct {
 		ip              string
-		expectedDecimal int
+		expectedDecimal string
 	}{
 		{
 			ip:              "0.0.0.0",
-			expectedDecimal: 0,
-		},
-		{
-			ip:              "0.0.05.3",
-			expectedDecimal: 1283,
+			expectedDecimal: "0",
 		},
 		{
 			ip:              "0.0.5.3",
-			expectedDecimal: 1283,
+			expectedDecimal: "1283",
 		},
 		{
 			ip:              "10.0.0.0",
-			expectedDecimal: 167772160,
+			expectedDecimal: "167772160",
 		},
 		{
 			ip:              "10.4.0.0",
-			expectedDecimal: 168034304,
+			expectedDecimal: "168034304",
 		},
 		{
 			ip:              "255.255.255.255",
-			expectedDecimal: 4294967295,
+			expectedDecimal: "4294967295",
+		},
+		{
+			ip:              "::",
+			expectedDecimal: "0",
+		},
+		{
+			ip:              "::1:0:0",
+			expectedDecimal: "4294967296",
+		},
+		{
+			ip:              "fd00::",
+			expectedDecimal: "336294682933583715844663186250927177728",
+		},
+		{
+			ip:              "ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff",
+			expectedDecimal: "340282366920938463463374607431768211455",
 		},
 	}
 
 	for index, test := range tests {
 		returnedDecimal := ipToDecimal(net.ParseIP(test.ip))
 
-		if returnedDecimal != test.expectedDecimal {
+		if returnedDecimal.String() != test.expectedDecimal {
 			t.Fatalf(
 				"%v: unexpected decimal returned.\nexpected: %v, returned: %v",
 				index,
@@ -1209,6 +1584,30 @@ func TestNewIPRange(t *testing.T) {
 				end:   net.ParseIP("172.168.0.127").To4(),
 			},
 		},
+
+		{
+			network: "::/0",
+			expectedIPRange: ipRange{
+				start: net.ParseIP("::"),
+				end:   net.ParseIP("ffff:ffff:ffff:ffff:ffff:ffff:ffff:ffff"),
+			},
+		},
+
+		{
+			network: "fd00::/48",
+			expectedIPRange: ipRange{
+				start: net.ParseIP("fd00::"),
+				end:   net.ParseIP("fd00:0:0:ffff:ffff:ffff:ffff:ffff"),
+			},
+		},
+
+		{
+			network: "fd00::1/128",
+			expectedIPRange: ipRange{
+				start: net.ParseIP("fd00::1"),
+				end:   net.ParseIP("fd00::1"),
+			},
+		},
 	}
 
 	for index, test := range tests {
@@ -1230,42 +1629,70 @@ func TestNewIPRange(t *testing.T) {
 func TestSize(t *testing.T) {
 	tests := []struct {
 		mask         int
-		expectedSize int
+		bits         int
+		expectedSize string
 	}{
 		{
 			mask:         0,
-			expectedSize: 4294967296,
+			bits:         32,
+			expectedSize: "4294967296",
 		},
 		{
 			mask:         1,
-			expectedSize: 2147483648,
+			bits:         32,
+			expectedSize: "2147483648",
 		},
 		{
 			mask:         23,
-			expectedSize: 512,
+			bits:         32,
+			expectedSize: "512",
 		},
 		{
 			mask:         24,
-			expectedSize: 256,
+			bits:         32,
+			expectedSize: "256",
 		},
 		{
 			mask:         25,
-			expectedSize: 128,
+			bits:         32,
+			expectedSize: "128",
 		},
 		{
 			mask:         31,
-			expectedSize: 2,
+			bits:         32,
+			expectedSize: "2",
 		},
 		{
 			mask:         32,
-			expectedSize: 1,
+			bits:         32,
+			expectedSize: "1",
+		},
+		{
+			mask:         0,
+			bits:         128,
+			expectedSize: "340282366920938463463374607431768211456",
+		},
+		{
+			mask:         48,
+			bits:         128,
+			expectedSize: "1208925819614629174706176",
+		},
+		{
+			mask:         64,
+			bits:         128,
+			expectedSize: "18446744073709551616",
+		},
+		{
+			mask:         128,
+			bits:         128,
+			expectedSize: "1",
 		},
 	}
 
 	for index, test := range tests {
-		returnedSize := size(net.CIDRMask(test.mask, 32))
+		returnedSize := size(net.CIDRMask(test.mask, test.bits))
 
-		if returnedSize != test.expectedSize {
+		if returnedSize.String() != test.expectedSize {
 			t.Fatalf(
 				"%v: unexpected size returned.\nexpected: %v, returned: %v",
 				index,
@@ -1361,10 +1788,36 @@ func TestSpace(t *testing.T) {
 			mask:       24,
 			expectedIP: net.ParseIP("10.1.3.0"),
 		},
+
+		// Test allocating /64 network when the first free IPv6 range is not
+		// aligned to a /64.
+		{
+			freeIPRanges: []ipRange{
+				{
+					start: net.ParseIP("fd00::8000:0:0:0"),
+					end:   net.ParseIP("fd00:0:0:ffff:ffff:ffff:ffff:ffff"),
+				},
+			},
+			mask:       64,
+			expectedIP: net.ParseIP("fd00:0:0:1::"),
+		},
+
+		// Test adding an IPv6 network that is too large.
+		{
+			freeIPRanges: []ipRange{
+				{
+					start: net.ParseIP("fd00::"),
+					end:   net.ParseIP("fd00:0:0:ffff:ffff:ffff:ffff:ffff"),
+				},
+			},
+			mask:                 47,
+			expectedErrorHandler: IsSpaceExhausted,
+		},
 	}
 
 	for index, test := range tests {
-		mask := net.CIDRMask(test.mask, 32)
+		bits := 8 * ipLength(test.freeIPRanges[0].start)
+		mask := net.CIDRMask(test.mask, bits)
 
 		ip, err := space(test.freeIPRanges, mask)
 
@@ -1434,6 +1887,17 @@ func Test_Split(t *testing.T) {
 			expectedSubnets: nil,
 			errorMatcher:    IsInvalidParameter,
 		},
+		{
+			name:    "case 3: split IPv6 /48 into three networks",
+			network: mustParseCIDR("fd00::/48"),
+			n:       3,
+			expectedSubnets: []net.IPNet{
+				mustParseCIDR("fd00::/50"),
+				mustParseCIDR("fd00:0:0:4000::/50"),
+				mustParseCIDR("fd00:0:0:8000::/50"),
+			},
+			errorMatcher: nil,
+		},
 	}
 
 	for _, tc := range testCases {
@@ -1468,6 +1932,128 @@ func Test_Split(t *testing.T) {
 	}
 }
 
+func Test_SplitVariable(t *testing.T) {
+	testCases := []struct {
+		name            string
+		network         net.IPNet
+		masks           []net.IPMask
+		expectedSubnets []net.IPNet
+		errorMatcher    func(error) bool
+	}{
+		{
+			name:    "case 0: split /19 into one /20, two /24 and four /26",
+			network: mustParseCIDR("10.0.0.0/19"),
+			masks: []net.IPMask{
+				net.CIDRMask(26, 32),
+				net.CIDRMask(24, 32),
+				net.CIDRMask(20, 32),
+				net.CIDRMask(26, 32),
+				net.CIDRMask(24, 32),
+				net.CIDRMask(26, 32),
+				net.CIDRMask(26, 32),
+			},
+			expectedSubnets: []net.IPNet{
+				mustParseCIDR("10.0.18.0/26"),
+				mustParseCIDR("10.0.16.0/24"),
+				mustParseCIDR("10.0.0.0/20"),
+				mustParseCIDR("10.0.18.64/26"),
+				mustParseCIDR("10.0.17.0/24"),
+				mustParseCIDR("10.0.18.128/26"),
+				mustParseCIDR("10.0.18.192/26"),
+			},
+			errorMatcher: nil,
+		},
+		{
+			name:    "case 1: fill the network exactly",
+			network: mustParseCIDR("192.168.8.0/24"),
+			masks: []net.IPMask{
+				net.CIDRMask(26, 32),
+				net.CIDRMask(25, 32),
+				net.CIDRMask(26, 32),
+			},
+			expectedSubnets: []net.IPNet{
+				mustParseCIDR("192.168.8.128/26"),
+				mustParseCIDR("192.168.8.0/25"),
+				mustParseCIDR("192.168.8.192/26"),
+			},
+			errorMatcher: nil,
+		},
+		{
+			name:    "case 2: subnets do not fit",
+			network: mustParseCIDR("192.168.8.0/24"),
+			masks: []net.IPMask{
+				net.CIDRMask(25, 32),
+				net.CIDRMask(26, 32),
+				net.CIDRMask(25, 32),
+			},
+			expectedSubnets: nil,
+			errorMatcher:    IsSpaceExhausted,
+		},
+		{
+			name:    "case 3: split IPv6 /48 into one /49 and two /64",
+			network: mustParseCIDR("fd00::/48"),
+			masks: []net.IPMask{
+				net.CIDRMask(64, 128),
+				net.CIDRMask(49, 128),
+				net.CIDRMask(64, 128),
+			},
+			expectedSubnets: []net.IPNet{
+				mustParseCIDR("fd00:0:0:8000::/64"),
+				mustParseCIDR("fd00::/49"),
+				mustParseCIDR("fd00:0:0:8001::/64"),
+			},
+			errorMatcher: nil,
+		},
+		{
+			name:            "case 4: no masks",
+			network:         mustParseCIDR("192.168.8.0/24"),
+			masks:           nil,
+			expectedSubnets: []net.IPNet{},
+			errorMatcher:    nil,
+		},
+		{
+			name:    "case 5: mask larger than the network",
+			network: mustParseCIDR("192.168.8.0/24"),
+			masks: []net.IPMask{
+				net.CIDRMask(26, 32),
+				net.CIDRMask(23, 32),
+			},
+			expectedSubnets: nil,
+			errorMatcher:    IsSpaceExhausted,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			subnets, err := SplitVariable(tc.network, tc.masks)
+
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.errorMatcher(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if !reflect.DeepEqual(subnets, tc.expectedSubnets) {
+				msg := "expected subs: {\n"
+				for _, n := range tc.expectedSubnets {
+					msg += fmt.Sprintf("\t%s,\n", n.String())
+				}
+				msg += "}\n\ngot subs: {\n"
+				for _, n := range subnets {
+					msg += fmt.Sprintf("\t%s,\n", n.String())
+				}
+				msg += "}"
+				t.Fatal(msg)
+			}
+		})
+	}
+}
+
 func Test_Sort(t *testing.T) {
 	testCases := []struct {
 		name                  string
@@ -1500,6 +2086,21 @@ func Test_Sort(t *testing.T) {
 				mustParseCIDR("192.168.8.0/26"),
 			},
 		},
+		{
+			name: "case 3: sort IPv6 subnets",
+			subnets: []net.IPNet{
+				mustParseCIDR("fd00:0:0:ff00::/56"),
+				mustParseCIDR("fd00::/64"),
+				mustParseCIDR("fd00::/56"),
+				mustParseCIDR("fd00:0:0:100::/56"),
+			},
+			expectedSortedSubnets: []net.IPNet{
+				mustParseCIDR("fd00::/56"),
+				mustParseCIDR("fd00::/64"),
+				mustParseCIDR("fd00:0:0:100::/56"),
+				mustParseCIDR("fd00:0:0:ff00::/56"),
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -1585,11 +2186,6 @@ func mustParseCIDR(val string) net.IPNet {
 	return *n
 }
 
-// ipNetEqual returns true if the given IPNets refer to the same network.
-func ipNetEqual(a, b net.IPNet) bool {
-	return a.IP.Equal(b.IP) && bytes.Equal(a.Mask, b.Mask)
-}
-
 // ipRangesEqual returns true if both given ipRanges are equal, false otherwise.
 func ipRangesEqual(a, b []ipRange) bool {
 	if len(a) != len(b) {
@@ -6,12 +6,97 @@ import (
 	"strings"
 )
 
-// encodeKey returns a full storage key for a given network.
+// poolKey returns the given storage key namespaced for the given pool. The
+// unnamed pool uses the key as is.
+// e.g: infra, /ipam/subnet -> /ipam/pool/infra/subnet
+func poolKey(pool, key string) string {
+	if pool == "" {
+		return key
+	}
+
+	return fmt.Sprintf(
+		"%s/%s/%s",
+		ipamPoolStorageKey,
+		pool,
+		strings.TrimPrefix(key, ipamStorageKey+"/"),
+	)
+}
+
+// encodeKey returns a full storage key for a given network of a given pool.
 // e.g: 10.4.0.0/16 -> /ipam/subnet/10.4.0.0-16
-func encodeKey(network net.IPNet) string {
+func encodeKey(pool string, network net.IPNet) string {
+	return encodeCIDRKey(poolKey(pool, ipamSubnetStorageKey), network)
+}
+
+// encodePairKey returns the storage key linking a dual-stack subnet to its
+// partner.
+// e.g: 10.4.0.0/16 -> /ipam/pair/10.4.0.0-16
+func encodePairKey(pool string, network net.IPNet) string {
+	return encodeCIDRKey(poolKey(pool, ipamPairStorageKey), network)
+}
+
+// encodeChildKey returns the storage key recording the child pool a subnet
+// of the given pool is delegated to, see Service.Delegate.
+// e.g: 10.4.0.0/16 -> /ipam/child/10.4.0.0-16
+func encodeChildKey(pool string, network net.IPNet) string {
+	return encodeCIDRKey(poolKey(pool, ipamChildStorageKey), network)
+}
+
+// encodeExpiryKey returns the storage key of the expiry of the given subnet,
+// see Service.CreateSubnetWithTTL.
+// e.g: 10.4.0.0/24 -> /ipam/expiry/10.4.0.0-24
+func encodeExpiryKey(pool string, network net.IPNet) string {
+	return encodeCIDRKey(poolKey(pool, ipamExpiryStorageKey), network)
+}
+
+// encodeHostKey returns the storage key of the given address allocated from
+// the given subnet, see HostAllocator.
+// e.g: 10.4.0.0/24, 10.4.0.5 -> /ipam/host/10.4.0.0-24/10.4.0.5
+func encodeHostKey(pool string, subnet net.IPNet, ip net.IP) string {
+	return fmt.Sprintf("%s/%s", encodeHostPrefix(pool, subnet), ip.String())
+}
+
+// encodeHostPrefix returns the storage key below which the addresses
+// allocated from the given subnet are stored.
+// e.g: 10.4.0.0/24 -> /ipam/host/10.4.0.0-24
+func encodeHostPrefix(pool string, subnet net.IPNet) string {
+	return encodeCIDRKey(poolKey(pool, ipamHostStorageKey), subnet)
+}
+
+// decodeHostKey returns an address, given a storage key of an allocated
+// address, relative to its subnet.
+// e.g: 10.4.0.5 -> 10.4.0.5
+func decodeHostKey(key string) string {
+	return strings.TrimPrefix(key, "/")
+}
+
+// encodeNetworkKey returns the storage key of a network attached to the given
+// pool, see Service.AddNetwork.
+// e.g: 10.5.0.0/16 -> /ipam/network/10.5.0.0-16
+func encodeNetworkKey(pool string, network net.IPNet) string {
+	return encodeCIDRKey(poolKey(pool, ipamNetworkStorageKey), network)
+}
+
+// encodeOwnerKey returns the storage key of the owner index entry of the
+// given owner.
+// e.g: cluster-1 -> /ipam/owner/cluster-1
+func encodeOwnerKey(pool string, owner string) string {
+	return fmt.Sprintf("%s/%s", poolKey(pool, ipamOwnerStorageKey), owner)
+}
+
+// decodeOwnerKey returns an owner, given a storage key of the owner index.
+// e.g: /ipam/owner/cluster-1 -> cluster-1
+func decodeOwnerKey(key string) string {
+	key = strings.TrimPrefix(key, ipamOwnerStorageKey)
+	return strings.TrimPrefix(key, "/")
+}
+
+// encodeCIDRKey returns a storage key for a given network below the given
+// prefix.
+func encodeCIDRKey(prefix string, network net.IPNet) string {
 	return fmt.Sprintf(
 		"%s/%s",
-		ipamSubnetStorageKey,
+		prefix,
 		strings.Replace(network.String(), "/", "-", -1),
 	)
 }
@@ -2,12 +2,14 @@ package ipam
 
 import (
 	"net"
+	"strings"
 	"testing"
 )
 
 // TestEncodeKey tests the encodeKey function.
 func TestEncodeKey(t *testing.T) {
 	tests := []struct {
+		pool        string
 		network     string
 		expectedKey string
 	}{
@@ -19,6 +21,89 @@ func TestEncodeKey(t *testing.T) {
 			network:     "192.168.1.0/24",
 			expectedKey: "/ipam/subnet/192.168.1.0-24",
 		},
+		{
+			pool:        "workload-eu",
+			network:     "10.4.0.0/16",
+			expectedKey: "/ipam/pool/workload-eu/subnet/10.4.0.0-16",
+		},
+	}
+
+	for index, test := range tests {
+		_, network, err := net.ParseCIDR(test.network)
+		if err != nil {
+			t.Fatalf("%v: error returned parsing network cidr: %v", index, err)
+		}
+
+		returnedKey := encodeKey(test.pool, *network)
+
+		if returnedKey != test.expectedKey {
+			t.Fatalf(
+				"%v: returned key did not match expected key.\nexpected: %v\nreturned: %v\n",
+				index,
+				test.expectedKey,
+				returnedKey,
+			)
+		}
+	}
+}
+
+// TestEncodePairKey tests the encodePairKey function.
+func TestEncodePairKey(t *testing.T) {
+	tests := []struct {
+		pool        string
+		network     string
+		expectedKey string
+	}{
+		{
+			network:     "10.4.0.0/16",
+			expectedKey: "/ipam/pair/10.4.0.0-16",
+		},
+		{
+			network:     "fd00::/48",
+			expectedKey: "/ipam/pair/fd00::-48",
+		},
+		{
+			pool:        "infra",
+			network:     "fd00::/48",
+			expectedKey: "/ipam/pool/infra/pair/fd00::-48",
+		},
+	}
+
+	for index, test := range tests {
+		_, network, err := net.ParseCIDR(test.network)
+		if err != nil {
+			t.Fatalf("%v: error returned parsing network cidr: %v", index, err)
+		}
+
+		returnedKey := encodePairKey(test.pool, *network)
+
+		if returnedKey != test.expectedKey {
+			t.Fatalf(
+				"%v: returned key did not match expected key.\nexpected: %v\nreturned: %v\n",
+				index,
+				test.expectedKey,
+				returnedKey,
+			)
+		}
+	}
+}
+
+// TestEncodeNetworkKey tests the encodeNetworkKey function.
+func TestEncodeNetworkKey(t *testing.T) {
+	tests := []struct {
+		pool        string
+		network     string
+		expectedKey string
+	}{
+		{
+			network:     "10.5.0.0/16",
+			expectedKey: "/ipam/network/10.5.0.0-16",
+		},
+		{
+			pool:        "infra",
+			network:     "fd01::/48",
+			expectedKey: "/ipam/pool/infra/network/fd01::-48",
+		},
 	}
 
 	for index, test := range tests {
@@ -27,7 +112,7 @@ func TestEncodeKey(t *testing.T) {
 			t.Fatalf("%v: error returned parsing network cidr: %v", index, err)
 		}
 
-		returnedKey := encodeKey(*network)
+		returnedKey := encodeNetworkKey(test.pool, *network)
 
 		if returnedKey != test.expectedKey {
 			t.Fatalf(
@@ -69,3 +154,48 @@ func TestDecodeKey(t *testing.T) {
 		}
 	}
 }
+
+// TestOwnerKey tests the encodeOwnerKey and decodeOwnerKey functions.
+func TestOwnerKey(t *testing.T) {
+	tests := []struct {
+		pool        string
+		owner       string
+		expectedKey string
+	}{
+		{
+			owner:       "cluster-1",
+			expectedKey: "/ipam/owner/cluster-1",
+		},
+		{
+			owner:       "a8f3k",
+			expectedKey: "/ipam/owner/a8f3k",
+		},
+		{
+			pool:        "infra",
+			owner:       "a8f3k",
+			expectedKey: "/ipam/pool/infra/owner/a8f3k",
+		},
+	}
+
+	for index, test := range tests {
+		returnedKey := encodeOwnerKey(test.pool, test.owner)
+		if returnedKey != test.expectedKey {
+			t.Fatalf(
+				"%v: returned key did not match expected key.\nexpected: %v\nreturned: %v\n",
+				index,
+				test.expectedKey,
+				returnedKey,
+			)
+		}
+
+		returnedOwner := decodeOwnerKey(strings.TrimPrefix(returnedKey, poolKey(test.pool, ipamOwnerStorageKey)))
+		if returnedOwner != test.owner {
+			t.Fatalf(
+				"%v: returned owner did not match expected owner.\nexpected: %v\nreturned: %v\n",
+				index,
+				test.owner,
+				returnedOwner,
+			)
+		}
+	}
+}
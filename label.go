@@ -0,0 +1,201 @@
+package ipam
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/giantswarm/microerror"
+)
+
+var (
+	// labelKeyRegexp matches label keys, which consist of an optional DNS
+	// subdomain prefix and a name, e.g. giantswarm.io/cluster.
+	labelKeyRegexp = regexp.MustCompile(`^([a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*/)?[A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?$`)
+	// labelValueRegexp matches label values, which may be empty.
+	labelValueRegexp = regexp.MustCompile(`^([A-Za-z0-9]([-A-Za-z0-9_.]{0,61}[A-Za-z0-9])?)?$`)
+	// setRequirementRegexp matches selector requirements of the form
+	// `key in (a, b)` and `key notin (a, b)`.
+	setRequirementRegexp = regexp.MustCompile(`^(\S+)\s+(in|notin)\s*\((.*)\)$`)
+)
+
+type selectorOperator int
+
+const (
+	operatorEquals selectorOperator = iota
+	operatorNotEquals
+	operatorIn
+	operatorNotIn
+	operatorExists
+	operatorDoesNotExist
+)
+
+// requirement is a single, comma separated, part of a Selector.
+type requirement struct {
+	key      string
+	operator selectorOperator
+	values   []string
+}
+
+// Selector selects subnets by their labels, like Kubernetes label selectors
+// do. A subnet is selected when its labels meet all requirements of the
+// selector. Selectors are created with ParseSelector.
+type Selector struct {
+	requirements []requirement
+}
+
+// ParseSelector parses the given selector, in the syntax of Kubernetes label
+// selectors. A selector is a comma separated list of requirements, e.g.
+// `environment=production,tier!=frontend,purpose in (workload, infra),cluster`.
+// The supported requirements are `key=value`, `key==value`, `key!=value`,
+// `key in (values)`, `key notin (values)`, `key` and `!key`. The empty
+// selector selects all subnets.
+func ParseSelector(selector string) (Selector, error) {
+	if strings.TrimSpace(selector) == "" {
+		return Selector{}, nil
+	}
+
+	var requirements []requirement
+	for _, term := range splitSelector(selector) {
+		r, err := parseRequirement(strings.TrimSpace(term))
+		if err != nil {
+			return Selector{}, microerror.Mask(err)
+		}
+		requirements = append(requirements, r)
+	}
+
+	return Selector{requirements: requirements}, nil
+}
+
+// Matches returns true when the given labels meet all requirements of the
+// selector, false otherwise.
+func (s Selector) Matches(labels map[string]string) bool {
+	for _, r := range s.requirements {
+		value, ok := labels[r.key]
+
+		switch r.operator {
+		case operatorEquals:
+			if !ok || value != r.values[0] {
+				return false
+			}
+		case operatorNotEquals:
+			if ok && value == r.values[0] {
+				return false
+			}
+		case operatorIn:
+			if !ok || !containsString(r.values, value) {
+				return false
+			}
+		case operatorNotIn:
+			if ok && containsString(r.values, value) {
+				return false
+			}
+		case operatorExists:
+			if !ok {
+				return false
+			}
+		case operatorDoesNotExist:
+			if ok {
+				return false
+			}
+		}
+	}
+
+	return true
+}
+
+// validateLabels returns an error matched by IsInvalidParameter when any of
+// the given labels has an invalid key or value.
+func validateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if !labelKeyRegexp.MatchString(key) {
+			return microerror.Maskf(invalidParameterError, "label key %#q is invalid", key)
+		}
+		if !labelValueRegexp.MatchString(value) {
+			return microerror.Maskf(invalidParameterError, "label value %#q of key %#q is invalid", value, key)
+		}
+	}
+
+	return nil
+}
+
+// parseRequirement parses a single requirement of a selector.
+func parseRequirement(term string) (requirement, error) {
+	var r requirement
+
+	if m := setRequirementRegexp.FindStringSubmatch(term); m != nil {
+		r.key = m[1]
+		r.operator = operatorIn
+		if m[2] == "notin" {
+			r.operator = operatorNotIn
+		}
+		for _, value := range strings.Split(m[3], ",") {
+			r.values = append(r.values, strings.TrimSpace(value))
+		}
+	} else if strings.HasPrefix(term, "!") && !strings.Contains(term, "=") {
+		r.key = strings.TrimSpace(strings.TrimPrefix(term, "!"))
+		r.operator = operatorDoesNotExist
+	} else if i := strings.Index(term, "!="); i >= 0 {
+		r.key = strings.TrimSpace(term[:i])
+		r.operator = operatorNotEquals
+		r.values = []string{strings.TrimSpace(term[i+2:])}
+	} else if i := strings.Index(term, "=="); i >= 0 {
+		r.key = strings.TrimSpace(term[:i])
+		r.operator = operatorEquals
+		r.values = []string{strings.TrimSpace(term[i+2:])}
+	} else if i := strings.Index(term, "="); i >= 0 {
+		r.key = strings.TrimSpace(term[:i])
+		r.operator = operatorEquals
+		r.values = []string{strings.TrimSpace(term[i+1:])}
+	} else {
+		r.key = term
+		r.operator = operatorExists
+	}
+
+	if !labelKeyRegexp.MatchString(r.key) {
+		return requirement{}, microerror.Maskf(invalidParameterError, "selector requirement %#q has an invalid key", term)
+	}
+	for _, value := range r.values {
+		if !labelValueRegexp.MatchString(value) {
+			return requirement{}, microerror.Maskf(invalidParameterError, "selector requirement %#q has an invalid value %#q", term, value)
+		}
+	}
+
+	return r, nil
+}
+
+// splitSelector splits the given selector at the commas separating its
+// requirements, ignoring commas within the value lists of set requirements.
+func splitSelector(selector string) []string {
+	var terms []string
+
+	var depth int
+	var start int
+	for i, c := range selector {
+		switch c {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				terms = append(terms, selector[start:i])
+				start = i + 1
+			}
+		}
+	}
+	terms = append(terms, selector[start:])
+
+	return terms
+}
+
+// containsString returns true when the given list contains the given string,
+// false otherwise.
+func containsString(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+
+	return false
+}
@@ -0,0 +1,218 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestParseSelector tests the ParseSelector function and the matching of the
+// returned selectors.
+func TestParseSelector(t *testing.T) {
+	labels := map[string]string{
+		"cluster":              "a8f3k",
+		"environment":          "production",
+		"giantswarm.io/tier":   "frontend",
+		"purpose":              "workload",
+		"giantswarm.io/legacy": "",
+	}
+
+	tests := []struct {
+		name                 string
+		selector             string
+		expectedMatch        bool
+		expectedErrorHandler func(error) bool
+	}{
+		{
+			name:          "case 0: empty selector",
+			selector:      "",
+			expectedMatch: true,
+		},
+		{
+			name:          "case 1: equality",
+			selector:      "environment=production",
+			expectedMatch: true,
+		},
+		{
+			name:          "case 2: double equality with prefixed key",
+			selector:      "giantswarm.io/tier==frontend",
+			expectedMatch: true,
+		},
+		{
+			name:          "case 3: inequality",
+			selector:      "environment!=production",
+			expectedMatch: false,
+		},
+		{
+			name:          "case 4: inequality of a missing key",
+			selector:      "owner!=team-a",
+			expectedMatch: true,
+		},
+		{
+			name:          "case 5: set membership",
+			selector:      "purpose in (infra, workload)",
+			expectedMatch: true,
+		},
+		{
+			name:          "case 6: set exclusion",
+			selector:      "purpose notin (infra,workload)",
+			expectedMatch: false,
+		},
+		{
+			name:          "case 7: existence",
+			selector:      "cluster",
+			expectedMatch: true,
+		},
+		{
+			name:          "case 8: existence of a key with an empty value",
+			selector:      "giantswarm.io/legacy",
+			expectedMatch: true,
+		},
+		{
+			name:          "case 9: non-existence",
+			selector:      "!cluster",
+			expectedMatch: false,
+		},
+		{
+			name:          "case 10: all requirements must match",
+			selector:      "environment=production, purpose in (infra, workload), cluster=b7d2x",
+			expectedMatch: false,
+		},
+		{
+			name:          "case 11: all requirements match",
+			selector:      "environment=production,purpose in (infra,workload),!owner",
+			expectedMatch: true,
+		},
+		{
+			name:                 "case 12: invalid key",
+			selector:             "-cluster=a8f3k",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 13: invalid value",
+			selector:             "cluster=a8f3k!",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 14: empty requirement",
+			selector:             "cluster=a8f3k,",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			selector, err := ParseSelector(tc.selector)
+
+			switch {
+			case err == nil && tc.expectedErrorHandler == nil:
+				// correct; carry on
+			case err != nil && tc.expectedErrorHandler == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.expectedErrorHandler != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.expectedErrorHandler(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.expectedErrorHandler != nil {
+				return
+			}
+
+			if selector.Matches(labels) != tc.expectedMatch {
+				t.Fatalf("match == %v, want %v", !tc.expectedMatch, tc.expectedMatch)
+			}
+		})
+	}
+}
+
+// TestCreateSubnetWithLabels tests that subnets created with labels can be
+// selected by their labels.
+func TestCreateSubnetWithLabels(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	mask := net.CIDRMask(24, 32)
+
+	annotated, err := service.CreateSubnet(ctx, mask, "legacy", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	production, err := service.CreateSubnetWithLabels(ctx, mask, map[string]string{"environment": "production", "cluster": "a8f3k"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	staging, err := service.CreateSubnetWithLabels(ctx, mask, map[string]string{"environment": "staging", "cluster": "b7d2x"}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	_, err = service.CreateSubnetWithLabels(ctx, mask, map[string]string{"environment": "not valid"}, nil)
+	if !IsInvalidParameter(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+
+	subnet, err := service.GetSubnet(ctx, production)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting subnet: %v", err)
+	}
+	if subnet.Labels["cluster"] != "a8f3k" || subnet.Annotation != "" {
+		t.Fatalf("subnet == %#v, want labels only", subnet)
+	}
+
+	tests := []struct {
+		selector        string
+		expectedSubnets []net.IPNet
+	}{
+		{
+			selector:        "",
+			expectedSubnets: []net.IPNet{annotated, production, staging},
+		},
+		{
+			selector:        "environment=production",
+			expectedSubnets: []net.IPNet{production},
+		},
+		{
+			selector:        "environment in (production, staging)",
+			expectedSubnets: []net.IPNet{production, staging},
+		},
+		{
+			selector:        "!cluster",
+			expectedSubnets: []net.IPNet{annotated},
+		},
+	}
+
+	for index, test := range tests {
+		found, err := service.FindByLabels(ctx, test.selector)
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned finding subnets: %v", index, err)
+		}
+
+		if len(found) != len(test.expectedSubnets) {
+			t.Fatalf("%v: found %v, want %v", index, found, test.expectedSubnets)
+		}
+		for i := range found {
+			if !ipNetEqual(found[i].Network, test.expectedSubnets[i]) {
+				t.Fatalf("%v: found %v, want %v", index, found, test.expectedSubnets)
+			}
+		}
+	}
+}
@@ -0,0 +1,108 @@
+package ipam
+
+import (
+	"net"
+	"sort"
+
+	"github.com/giantswarm/microerror"
+)
+
+// Tier is a tier of a layout, e.g. the public or the private subnets of a
+// cluster, see Layout.
+type Tier struct {
+	Name string
+	// Weight is the size of the tier, relative to the other tiers.
+	Weight uint
+}
+
+// ZoneTier identifies the subnet of a tier within an availability zone, see
+// Layout.
+type ZoneTier struct {
+	Zone string
+	Tier string
+}
+
+// Layout splits the given network across the given availability zones, and
+// the subnet of each zone across the given tiers, and returns the subnet of
+// each tier within each zone. The network is split into equally sized zone
+// subnets, assigned to the zones in alphabetical order. Each tier is given
+// the largest subnet not exceeding its share of the weights of all tiers,
+// packed in the order of the tiers. The layout only depends on the given
+// network, zones and tiers, so that it is safe to reconcile against.
+//
+// Example:
+//	  network: 10.0.0.0/16
+//	  zones: [eu-west-1b, eu-west-1a]
+//	  tiers: [{private 3}, {public 1}]
+//	  returned: {eu-west-1a private}: 10.0.0.0/18, {eu-west-1a public}: 10.0.64.0/19,
+//	            {eu-west-1b private}: 10.0.128.0/18, {eu-west-1b public}: 10.0.192.0/19
+//
+func Layout(network net.IPNet, zones []string, tiers []Tier) (map[ZoneTier]net.IPNet, error) {
+	if len(zones) == 0 {
+		return nil, microerror.Maskf(invalidParameterError, "zones must not be empty")
+	}
+	if len(tiers) == 0 {
+		return nil, microerror.Maskf(invalidParameterError, "tiers must not be empty")
+	}
+
+	sorted := append([]string(nil), zones...)
+	sort.Strings(sorted)
+	for i, zone := range sorted {
+		if zone == "" {
+			return nil, microerror.Maskf(invalidParameterError, "zone name must not be empty")
+		}
+		if i > 0 && zone == sorted[i-1] {
+			return nil, microerror.Maskf(invalidParameterError, "zone %#q must only be given once", zone)
+		}
+	}
+
+	var total uint
+	names := map[string]bool{}
+	for _, tier := range tiers {
+		if tier.Name == "" {
+			return nil, microerror.Maskf(invalidParameterError, "tier name must not be empty")
+		}
+		if names[tier.Name] {
+			return nil, microerror.Maskf(invalidParameterError, "tier %#q must only be given once", tier.Name)
+		}
+		if tier.Weight == 0 {
+			return nil, microerror.Maskf(invalidParameterError, "weight of tier %#q must be positive", tier.Name)
+		}
+		names[tier.Name] = true
+		total += tier.Weight
+	}
+
+	network.IP = network.IP.Mask(network.Mask)
+
+	zoneSubnets, err := Split(network, uint(len(sorted)))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	layout := map[ZoneTier]net.IPNet{}
+	for i, zone := range sorted {
+		// A tier of weight w fits into 1 of total/w subnets of the zone,
+		// rounded up to keep the tier within its share.
+		var masks []net.IPMask
+		for _, tier := range tiers {
+			n := (total + tier.Weight - 1) / tier.Weight
+
+			mask, err := CalculateSubnetMask(zoneSubnets[i].Mask, n)
+			if err != nil {
+				return nil, microerror.Mask(err)
+			}
+			masks = append(masks, mask)
+		}
+
+		tierSubnets, err := SplitVariable(zoneSubnets[i], masks)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		for j, tier := range tiers {
+			layout[ZoneTier{Zone: zone, Tier: tier.Name}] = tierSubnets[j]
+		}
+	}
+
+	return layout, nil
+}
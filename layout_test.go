@@ -0,0 +1,133 @@
+package ipam
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func Test_Layout(t *testing.T) {
+	testCases := []struct {
+		name           string
+		network        net.IPNet
+		zones          []string
+		tiers          []Tier
+		expectedLayout map[ZoneTier]string
+		errorMatcher   func(error) bool
+	}{
+		{
+			name:    "case 0: two zones with weighted tiers",
+			network: mustParseCIDR("10.0.0.0/16"),
+			zones:   []string{"eu-west-1b", "eu-west-1a"},
+			tiers:   []Tier{{Name: "private", Weight: 3}, {Name: "public", Weight: 1}},
+			expectedLayout: map[ZoneTier]string{
+				{Zone: "eu-west-1a", Tier: "private"}: "10.0.0.0/18",
+				{Zone: "eu-west-1a", Tier: "public"}:  "10.0.64.0/19",
+				{Zone: "eu-west-1b", Tier: "private"}: "10.0.128.0/18",
+				{Zone: "eu-west-1b", Tier: "public"}:  "10.0.192.0/19",
+			},
+			errorMatcher: nil,
+		},
+		{
+			name:    "case 1: three zones halved into public and private",
+			network: mustParseCIDR("10.1.0.0/16"),
+			zones:   []string{"a", "b", "c"},
+			tiers:   []Tier{{Name: "public", Weight: 1}, {Name: "private", Weight: 1}},
+			expectedLayout: map[ZoneTier]string{
+				{Zone: "a", Tier: "public"}:  "10.1.0.0/19",
+				{Zone: "a", Tier: "private"}: "10.1.32.0/19",
+				{Zone: "b", Tier: "public"}:  "10.1.64.0/19",
+				{Zone: "b", Tier: "private"}: "10.1.96.0/19",
+				{Zone: "c", Tier: "public"}:  "10.1.128.0/19",
+				{Zone: "c", Tier: "private"}: "10.1.160.0/19",
+			},
+			errorMatcher: nil,
+		},
+		{
+			name:    "case 2: larger tiers are placed first",
+			network: mustParseCIDR("10.2.0.0/24"),
+			zones:   []string{"a"},
+			tiers:   []Tier{{Name: "lb", Weight: 1}, {Name: "workers", Weight: 4}, {Name: "masters", Weight: 1}},
+			expectedLayout: map[ZoneTier]string{
+				{Zone: "a", Tier: "lb"}:      "10.2.0.128/27",
+				{Zone: "a", Tier: "workers"}: "10.2.0.0/25",
+				{Zone: "a", Tier: "masters"}: "10.2.0.160/27",
+			},
+			errorMatcher: nil,
+		},
+		{
+			name:    "case 3: IPv6 network",
+			network: mustParseCIDR("fd00::/48"),
+			zones:   []string{"a", "b"},
+			tiers:   []Tier{{Name: "nodes", Weight: 1}},
+			expectedLayout: map[ZoneTier]string{
+				{Zone: "a", Tier: "nodes"}: "fd00::/49",
+				{Zone: "b", Tier: "nodes"}: "fd00:0:0:8000::/49",
+			},
+			errorMatcher: nil,
+		},
+		{
+			name:         "case 4: duplicate zones",
+			network:      mustParseCIDR("10.0.0.0/16"),
+			zones:        []string{"a", "b", "a"},
+			tiers:        []Tier{{Name: "nodes", Weight: 1}},
+			errorMatcher: IsInvalidParameter,
+		},
+		{
+			name:         "case 5: tier without weight",
+			network:      mustParseCIDR("10.0.0.0/16"),
+			zones:        []string{"a"},
+			tiers:        []Tier{{Name: "nodes"}},
+			errorMatcher: IsInvalidParameter,
+		},
+		{
+			name:         "case 6: network too small for the zones",
+			network:      mustParseCIDR("10.0.0.0/31"),
+			zones:        []string{"a", "b", "c"},
+			tiers:        []Tier{{Name: "nodes", Weight: 1}},
+			errorMatcher: IsInvalidParameter,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			layout, err := Layout(tc.network, tc.zones, tc.tiers)
+
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.errorMatcher(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.errorMatcher != nil {
+				return
+			}
+
+			got := map[ZoneTier]string{}
+			for k, subnet := range layout {
+				got[k] = subnet.String()
+			}
+			if !reflect.DeepEqual(got, tc.expectedLayout) {
+				t.Fatalf("expected layout %v, got %v", tc.expectedLayout, got)
+			}
+
+			// The layout must not depend on the order of the zones.
+			reversed := make([]string, len(tc.zones))
+			for i, zone := range tc.zones {
+				reversed[len(tc.zones)-1-i] = zone
+			}
+			again, err := Layout(tc.network, reversed, tc.tiers)
+			if err != nil {
+				t.Fatalf("error == %#v, want nil", err)
+			}
+			if !reflect.DeepEqual(again, layout) {
+				t.Fatalf("expected layout %v, got %v", layout, again)
+			}
+		})
+	}
+}
@@ -0,0 +1,305 @@
+package ipam
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/microstorage"
+)
+
+const (
+	// lockRetryInterval is the time waited before trying again to acquire
+	// the storage lock, when it is held by another process.
+	lockRetryInterval = 10 * time.Millisecond
+	// lockReleaseTimeout is the time given to releasing the storage lock.
+	lockReleaseTimeout = 5 * time.Second
+	// lockRenewInterval is the time after which a held storage lock is
+	// renewed, well before it expires.
+	lockRenewInterval = lockTTL / 3
+	// lockSettleDelay is the time waited after writing the storage lock,
+	// before reading it back to verify ownership. Processes racing for the
+	// lock usually land their writes within this delay, so that only the
+	// last writer considers itself the owner. This is not guaranteed, see
+	// lock.
+	lockSettleDelay = 5 * time.Millisecond
+	// lockTTL is the time after which a storage lock which has not been
+	// renewed is considered abandoned, e.g. because its owner crashed, and
+	// may be taken over.
+	lockTTL = 30 * time.Second
+)
+
+// lease is the value stored under the storage lock key.
+type lease struct {
+	Owner   string    `json:"owner"`
+	Expires time.Time `json:"expires"`
+}
+
+// poolMutexes holds the mutexes shared by all services of the same storage
+// and pool within this process, see poolMutex.
+var poolMutexes sync.Map
+
+// poolMutexKey identifies a pool within a storage.
+type poolMutexKey struct {
+	storage microstorage.Storage
+	pool    string
+}
+
+// poolMutex returns the mutex serialising allocations of the given pool of
+// the given storage within this process. Storages which cannot be compared,
+// and thus not be told apart, get a mutex of their own.
+func poolMutex(storage microstorage.Storage, pool string) *sync.Mutex {
+	if !reflect.TypeOf(storage).Comparable() {
+		return &sync.Mutex{}
+	}
+
+	m, _ := poolMutexes.LoadOrStore(poolMutexKey{storage: storage, pool: pool}, &sync.Mutex{})
+
+	return m.(*sync.Mutex)
+}
+
+// lock serialises allocations. Allocations of the same pool within this
+// process are serialised with a mutex, shared by all services of the pool,
+// see poolMutex. With Config.StorageLock, allocations of different processes
+// sharing the same storage are serialised with a lease stored under
+// ipamLockStorageKey.
+//
+// microstorage.Storage does not offer an atomic compare-and-set, so the lease
+// is claimed by writing it, waiting for lockSettleDelay, and reading it back.
+// The lease is renewed every lockRenewInterval while it is held, and verified
+// once more before the allocation is written, see checkLock. Expiries are
+// checked against the configured clock, so processes sharing the same storage
+// must have synchronised clocks.
+//
+// The lease is best-effort. Processes whose writes to the storage are delayed
+// beyond lockSettleDelay, or which stall between checkLock and their write,
+// may hold it at the same time. Within a single process, the mutex does
+// guarantee that allocations never overlap.
+//
+// The returned function releases the lock and must always be called.
+func (s *Service) lock(ctx context.Context) (func(), error) {
+	s.mutex.Lock()
+
+	unlock := s.mutex.Unlock
+	if s.storageLock {
+		owner, err := s.acquireLease(ctx)
+		if err != nil {
+			s.mutex.Unlock()
+			return nil, microerror.Mask(err)
+		}
+
+		done := make(chan struct{})
+		renewed := make(chan struct{})
+		go func() {
+			defer close(renewed)
+			s.renewLease(ctx, owner, done)
+		}()
+
+		unlock = func() {
+			close(done)
+			<-renewed
+
+			// The lease is released even when the context of the caller is
+			// done, e.g. because the operation timed out, so that other
+			// processes need not wait for it to expire.
+			releaseCtx, cancel := context.WithTimeout(context.Background(), lockReleaseTimeout)
+			err := s.releaseLease(releaseCtx, owner)
+			cancel()
+			if err != nil {
+				s.logger.LogCtx(ctx, "level", "error", "message", "failed to release storage lock", "stack", fmt.Sprintf("%#v", err))
+			}
+			s.lockOwner = ""
+			s.mutex.Unlock()
+		}
+		s.lockOwner = owner
+	}
+
+	// Child pools must not allocate anymore once their delegation has been
+	// deleted, see undelegate.
+	err := s.checkParent(ctx)
+	if err != nil {
+		unlock()
+		return nil, microerror.Mask(err)
+	}
+
+	return unlock, nil
+}
+
+// checkLock verifies that the storage lock acquired by lock is still held,
+// i.e. that it has neither expired nor been taken over by another process.
+// It must only be called while holding the lock. Without Config.StorageLock,
+// there is no storage lock, and nil is returned.
+func (s *Service) checkLock(ctx context.Context) error {
+	if !s.storageLock {
+		return nil
+	}
+
+	l, err := s.searchLease(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if l == nil || l.Owner != s.lockOwner || !s.clock().Before(l.Expires) {
+		return microerror.Maskf(lockLostError, "storage lock is not held anymore")
+	}
+
+	return nil
+}
+
+// acquireLease blocks until the storage lock is held, or the context is
+// done, and returns the owner token identifying the lease.
+func (s *Service) acquireLease(ctx context.Context) (string, error) {
+	owner, err := newLockOwner()
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+
+	for {
+		l, err := s.searchLease(ctx)
+		if err != nil {
+			return "", microerror.Mask(err)
+		}
+
+		if l == nil || !s.clock().Before(l.Expires) {
+			err := s.putLease(ctx, lease{Owner: owner, Expires: s.clock().Add(lockTTL)})
+			if err != nil {
+				return "", microerror.Mask(err)
+			}
+
+			err = sleep(ctx, lockSettleDelay)
+			if err != nil {
+				return "", microerror.Mask(err)
+			}
+
+			l, err = s.searchLease(ctx)
+			if err != nil {
+				return "", microerror.Mask(err)
+			}
+			if l != nil && l.Owner == owner {
+				return owner, nil
+			}
+		}
+
+		err = sleep(ctx, lockRetryInterval)
+		if err != nil {
+			return "", microerror.Mask(err)
+		}
+	}
+}
+
+// renewLease extends the storage lock held by the given owner every
+// lockRenewInterval, until done is closed. It stops once the lease has been
+// lost, which is then reported by checkLock.
+func (s *Service) renewLease(ctx context.Context, owner string, done <-chan struct{}) {
+	t := time.NewTicker(lockRenewInterval)
+	defer t.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-done:
+			return
+		case <-t.C:
+		}
+
+		l, err := s.searchLease(ctx)
+		if err != nil {
+			s.logger.LogCtx(ctx, "level", "error", "message", "failed to renew storage lock", "stack", fmt.Sprintf("%#v", err))
+			continue
+		}
+		if l == nil || l.Owner != owner || !s.clock().Before(l.Expires) {
+			return
+		}
+
+		err = s.putLease(ctx, lease{Owner: owner, Expires: s.clock().Add(lockTTL)})
+		if err != nil {
+			s.logger.LogCtx(ctx, "level", "error", "message", "failed to renew storage lock", "stack", fmt.Sprintf("%#v", err))
+		}
+	}
+}
+
+// releaseLease deletes the storage lock, if it is still held by the given
+// owner.
+func (s *Service) releaseLease(ctx context.Context, owner string) error {
+	l, err := s.searchLease(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if l == nil || l.Owner != owner {
+		return nil
+	}
+
+	err = s.delete(ctx, poolKey(s.pool, ipamLockStorageKey))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// searchLease returns the current storage lock, or nil if there is none.
+func (s *Service) searchLease(ctx context.Context) (*lease, error) {
+	k, err := microstorage.NewK(poolKey(s.pool, ipamLockStorageKey))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var l lease
+	err = json.Unmarshal([]byte(kv.Val()), &l)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return &l, nil
+}
+
+// putLease writes the given lease as the storage lock.
+func (s *Service) putLease(ctx context.Context, l lease) error {
+	b, err := json.Marshal(l)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	err = s.put(ctx, poolKey(s.pool, ipamLockStorageKey), string(b))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// newLockOwner returns a random token identifying a storage lock owner.
+func newLockOwner() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+// sleep waits for the given duration, or until the context is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-ctx.Done():
+		return microerror.Mask(ctx.Err())
+	case <-t.C:
+		return nil
+	}
+}
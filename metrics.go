@@ -1,6 +1,8 @@
 package ipam
 
 import (
+	"math/big"
+	"strconv"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -11,12 +13,46 @@ const (
 )
 
 var (
-	subnetCounter = prometheus.NewGauge(
+	subnetCounter = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
 			Namespace: prometheusNamespace,
 			Name:      "subnet_total",
 			Help:      "Number of total subnets.",
 		},
+		[]string{"pool"},
+	)
+
+	addressesAllocated = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "addresses_allocated",
+			Help:      "Number of allocated addresses within a network.",
+		},
+		[]string{"pool", "network"},
+	)
+	addressesFree = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "addresses_free",
+			Help:      "Number of free addresses within a network.",
+		},
+		[]string{"pool", "network"},
+	)
+	largestFreeBlock = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "largest_free_block_addresses",
+			Help:      "Number of addresses of the largest subnet which can still be allocated within a network.",
+		},
+		[]string{"pool", "network"},
+	)
+	freeBlocks = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      "free_blocks",
+			Help:      "Number of free blocks within a network, by prefix length.",
+		},
+		[]string{"pool", "network", "prefix_length"},
 	)
 
 	subnetOperationDuration = prometheus.NewGaugeVec(
@@ -25,7 +61,7 @@ var (
 			Name:      "subnet_operation_duration_milliseconds",
 			Help:      "Time taken for subnet operations, in milliseconds.",
 		},
-		[]string{"operation_name"},
+		[]string{"pool", "operation_name"},
 	)
 	subnetOperationTotal = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
@@ -33,20 +69,50 @@ var (
 			Name:      "subnet_operation_total",
 			Help:      "Total number of subnet operations.",
 		},
-		[]string{"operation_name"},
+		[]string{"pool", "operation_name"},
 	)
 )
 
 func init() {
 	prometheus.MustRegister(subnetCounter)
 
+	prometheus.MustRegister(addressesAllocated)
+	prometheus.MustRegister(addressesFree)
+	prometheus.MustRegister(largestFreeBlock)
+	prometheus.MustRegister(freeBlocks)
+
 	prometheus.MustRegister(subnetOperationDuration)
 	prometheus.MustRegister(subnetOperationTotal)
 }
 
-func updateMetrics(name string, startTime time.Time) {
-	subnetOperationDuration.WithLabelValues(name).Set(
+func updateMetrics(pool, name string, startTime time.Time) {
+	subnetOperationDuration.WithLabelValues(pool, name).Set(
 		float64(time.Since(startTime) / time.Millisecond),
 	)
-	subnetOperationTotal.WithLabelValues(name).Inc()
+	subnetOperationTotal.WithLabelValues(pool, name).Inc()
+}
+
+func updateStatsMetrics(pool string, stats NetworkStats) {
+	network := stats.Network.String()
+
+	addressesAllocated.WithLabelValues(pool, network).Set(bigToFloat(stats.Allocated))
+	addressesFree.WithLabelValues(pool, network).Set(bigToFloat(stats.Free))
+
+	largest := big.NewInt(0)
+	if stats.LargestFreeMask != nil {
+		largest = size(stats.LargestFreeMask)
+	}
+	largestFreeBlock.WithLabelValues(pool, network).Set(bigToFloat(largest))
+
+	// All prefix lengths are set, so that those without free blocks are
+	// reported as zero, rather than with their previous value.
+	ones, bits := stats.Network.Mask.Size()
+	for prefixLength := ones; prefixLength <= bits; prefixLength++ {
+		freeBlocks.WithLabelValues(pool, network, strconv.Itoa(prefixLength)).Set(float64(stats.FreeBlocks[prefixLength]))
+	}
+}
+
+func bigToFloat(b *big.Int) float64 {
+	f, _ := new(big.Float).SetInt(b).Float64()
+	return f
 }
@@ -0,0 +1,172 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/microstorage"
+)
+
+// attachedNetwork is a network attached to a pool by AddNetwork, along with
+// its position in the order of attachment.
+type attachedNetwork struct {
+	network net.IPNet
+	index   int
+}
+
+// AddNetwork attaches the given network to the pool, expanding the space
+// subnets are allocated from. The network does not need to be contiguous with
+// the configured network, but must not overlap with it or any other attached
+// network. Subnets are allocated from the configured network first and then
+// from the attached networks of the same address family, in the order they
+// were attached. Attached networks are stored, so that they are used by all
+// services sharing the same storage and pool. Child pools, see Delegate,
+// cannot be expanded.
+func (s *Service) AddNetwork(ctx context.Context, network net.IPNet) error {
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("adding network %#q", network.String()))
+	defer updateMetrics(s.pool, "add_network", time.Now())
+
+	if !network.IP.Equal(network.IP.Mask(network.Mask)) {
+		return microerror.Maskf(invalidParameterError, "network %#q is not aligned to its mask", network.String())
+	}
+	if s.parent != nil {
+		return microerror.Maskf(invalidParameterError, "networks must not be added to child pool %#q", s.pool)
+	}
+	if !s.hasFamily(network) {
+		return microerror.Maskf(invalidParameterError, "network %#q does not match the address family of a configured network", network.String())
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	defer unlock()
+
+	attached, err := s.listAttachedNetworks(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	networks := []net.IPNet{s.network}
+	if s.ipv6Network != nil {
+		networks = append(networks, *s.ipv6Network)
+	}
+	index := 0
+	for _, a := range attached {
+		networks = append(networks, a.network)
+		if a.index >= index {
+			index = a.index + 1
+		}
+	}
+	for _, n := range networks {
+		if overlaps(network, n) {
+			return microerror.Maskf(overlapError, "network %#q overlaps with network %#q", network.String(), n.String())
+		}
+	}
+
+	if err := s.checkLock(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.put(ctx, encodeNetworkKey(s.pool, network), strconv.Itoa(index)); err != nil {
+		return microerror.Mask(err)
+	}
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("added network %#q", network.String()))
+
+	return nil
+}
+
+// Networks returns the networks subnets are allocated from, in the order they
+// are searched. These are the configured networks, followed by the networks
+// attached by AddNetwork.
+func (s *Service) Networks(ctx context.Context) ([]net.IPNet, error) {
+	attached, err := s.listAttachedNetworks(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	networks := s.expandNetwork(s.network, attached)
+	if s.ipv6Network != nil {
+		networks = append(networks, s.expandNetwork(*s.ipv6Network, attached)...)
+	}
+
+	return networks, nil
+}
+
+// expandNetwork returns the given configured network followed by the attached
+// networks of the same address family.
+func (s *Service) expandNetwork(network net.IPNet, attached []attachedNetwork) []net.IPNet {
+	networks := []net.IPNet{network}
+	for _, a := range attached {
+		if ipLength(a.network.IP) == ipLength(network.IP) {
+			networks = append(networks, a.network)
+		}
+	}
+
+	return networks
+}
+
+// familyNetworks returns the configured network of the address family of the
+// given mask, followed by the attached networks of the same family. Masks of
+// other families are given the IPv4 network, so that FreeInNetworks reports
+// the mismatch.
+func (s *Service) familyNetworks(mask net.IPMask, attached []attachedNetwork) []net.IPNet {
+	if s.ipv6Network != nil && len(mask) == ipLength(s.ipv6Network.IP) {
+		return s.expandNetwork(*s.ipv6Network, attached)
+	}
+
+	return s.expandNetwork(s.network, attached)
+}
+
+// hasFamily returns true if the given network belongs to the address family
+// of one of the configured networks, false otherwise.
+func (s *Service) hasFamily(network net.IPNet) bool {
+	if ipLength(network.IP) == ipLength(s.network.IP) {
+		return true
+	}
+	if s.ipv6Network != nil && ipLength(network.IP) == ipLength(s.ipv6Network.IP) {
+		return true
+	}
+
+	return false
+}
+
+// listAttachedNetworks returns the networks attached by AddNetwork, in the
+// order they were attached.
+func (s *Service) listAttachedNetworks(ctx context.Context) ([]attachedNetwork, error) {
+	k, err := microstorage.NewK(poolKey(s.pool, ipamNetworkStorageKey))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kvs, err := s.storage.List(ctx, k)
+	if err != nil && !microstorage.IsNotFound(err) {
+		return nil, microerror.Mask(err)
+	}
+
+	var attached []attachedNetwork
+	for _, kv := range kvs {
+		_, network, err := net.ParseCIDR(decodeKey(kv.Key()))
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		index, err := strconv.Atoi(kv.Val())
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		attached = append(attached, attachedNetwork{network: *network, index: index})
+	}
+
+	sort.Slice(attached, func(i, j int) bool {
+		return attached[i].index < attached[j].index
+	})
+
+	return attached, nil
+}
@@ -0,0 +1,161 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestAddNetwork tests that subnets are allocated from attached networks once
+// the configured network is exhausted.
+func TestAddNetwork(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/23")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	for _, n := range []string{"10.9.0.0/24", "10.8.0.0/24"} {
+		err := service.AddNetwork(ctx, mustParseCIDR(n))
+		if err != nil {
+			t.Fatalf("unexpected error returned adding network: %v", err)
+		}
+	}
+
+	// Attached networks are searched in the order they were attached, after
+	// the configured network.
+	expectedNetworks := []string{"10.4.0.0/23", "10.9.0.0/24", "10.8.0.0/24"}
+	networks, err := service.Networks(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing networks: %v", err)
+	}
+	if len(networks) != len(expectedNetworks) {
+		t.Fatalf("expected %v networks, got %v", len(expectedNetworks), networks)
+	}
+	for i, n := range networks {
+		if n.String() != expectedNetworks[i] {
+			t.Fatalf("network %v == %v, want %v", i, n.String(), expectedNetworks[i])
+		}
+	}
+
+	expectedSubnets := []string{"10.4.0.0/24", "10.4.1.0/24", "10.9.0.0/24", "10.8.0.0/24"}
+	for _, expected := range expectedSubnets {
+		subnet, err := service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error returned creating subnet: %v", err)
+		}
+		if subnet.String() != expected {
+			t.Fatalf("subnet == %v, want %v", subnet.String(), expected)
+		}
+	}
+
+	_, err = service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+	if !IsSpaceExhausted(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+
+	// Subnets within attached networks can be claimed explicitly once freed.
+	err = service.DeleteSubnet(ctx, mustParseCIDR("10.8.0.0/24"))
+	if err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+	err = service.CreateSubnetWithCIDR(ctx, mustParseCIDR("10.8.0.128/25"), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	// A second service sharing the storage sees the attached networks.
+	other, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+	subnet, err := other.CreateSubnet(ctx, net.CIDRMask(25, 32), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if subnet.String() != "10.8.0.0/25" {
+		t.Fatalf("subnet == %v, want %v", subnet.String(), "10.8.0.0/25")
+	}
+}
+
+// TestAddNetworkInvalid tests that AddNetwork refuses networks which cannot
+// be attached.
+func TestAddNetworkInvalid(t *testing.T) {
+	tests := []struct {
+		name                 string
+		network              net.IPNet
+		expectedErrorHandler func(error) bool
+	}{
+		{
+			name:                 "case 0: network overlapping the configured network",
+			network:              mustParseCIDR("10.4.0.0/15"),
+			expectedErrorHandler: IsOverlap,
+		},
+		{
+			name:                 "case 1: network overlapping an attached network",
+			network:              mustParseCIDR("10.9.4.0/24"),
+			expectedErrorHandler: IsOverlap,
+		},
+		{
+			name:                 "case 2: network of another address family",
+			network:              mustParseCIDR("fd00::/64"),
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 3: network not aligned to its mask",
+			network:              net.IPNet{IP: net.ParseIP("10.10.0.1").To4(), Mask: net.CIDRMask(16, 32)},
+			expectedErrorHandler: IsInvalidParameter,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			storage, err := memory.New(memory.Config{})
+			if err != nil {
+				t.Fatalf("error creating new storage: %v", err)
+			}
+
+			network := mustParseCIDR("10.4.0.0/16")
+
+			service, err := New(Config{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+				Network: &network,
+			})
+			if err != nil {
+				t.Fatalf("error returned creating ipam service: %v", err)
+			}
+
+			err = service.AddNetwork(ctx, mustParseCIDR("10.9.0.0/16"))
+			if err != nil {
+				t.Fatalf("unexpected error returned adding network: %v", err)
+			}
+
+			err = service.AddNetwork(ctx, tc.network)
+			if !tc.expectedErrorHandler(err) {
+				t.Fatalf("error == %#v, want matching", err)
+			}
+		})
+	}
+}
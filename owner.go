@@ -0,0 +1,185 @@
+package ipam
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/microstorage"
+)
+
+// CreateSubnetForOwner returns the subnet of the given owner, e.g. a cluster
+// ID. When the owner does not have a subnet yet, the next available subnet,
+// of the given size, is created like with CreateSubnet. Retrying the call,
+// e.g. after a crash, therefore never allocates a second subnet for the same
+// owner. The subnet of the owner is returned as it is stored, so that its
+// annotation and labels are kept, when retrying with a different annotation.
+// An error matched by IsInvalidParameter is returned when the subnet of the
+// owner has a different size than requested.
+func (s *Service) CreateSubnetForOwner(ctx context.Context, owner string, mask net.IPMask, annotation string, reserved []net.IPNet) (net.IPNet, error) {
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("creating subnet for owner %#q", owner))
+	defer updateMetrics(s.pool, "create_for_owner", time.Now())
+
+	if owner == "" || strings.Contains(owner, "/") {
+		return net.IPNet{}, microerror.Maskf(invalidParameterError, "owner %#q must not be empty or contain slashes", owner)
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+	defer unlock()
+
+	subnet, err := s.searchOwnedSubnet(ctx, owner)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	if subnet == nil {
+		attached, err := s.listAttachedNetworks(ctx)
+		if err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+		existingSubnets, err := s.listClaimedSubnets(ctx)
+		if err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+
+		free, err := s.freeSubnet(s.familyNetworks(mask, attached), mask, existingSubnets, reserved)
+		if err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+		subnet = &free
+
+		// The owner index is written before the subnet. It claims the subnet
+		// on its own, see listClaimedSubnets, so that a failure before the
+		// subnet is written neither leaks the subnet nor lets it be handed
+		// out to somebody else.
+		if err := s.checkLock(ctx); err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+		if err := s.put(ctx, encodeOwnerKey(s.pool, owner), subnet.String()); err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+	} else if !bytes.Equal(subnet.Mask, mask) {
+		return net.IPNet{}, microerror.Maskf(invalidParameterError, "owner %#q already holds subnet %#q", owner, subnet.String())
+	}
+
+	// The subnet is written when it is missing, even when the owner index
+	// already existed, as a previous call may have failed after writing the
+	// index only.
+	k, err := microstorage.NewK(encodeKey(s.pool, *subnet))
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+	exists, err := s.storage.Exists(ctx, k)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+	if !exists {
+		val, err := encodeRecord(annotation, nil)
+		if err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+		if err := s.checkLock(ctx); err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+		if err := s.put(ctx, encodeKey(s.pool, *subnet), val); err != nil {
+			return net.IPNet{}, microerror.Mask(err)
+		}
+	}
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("created subnet %#q for owner %#q", subnet.String(), owner))
+
+	return *subnet, nil
+}
+
+// listClaimedSubnets returns the stored subnets, along with the subnets
+// claimed by the owner index, which must not be handed out either.
+func (s *Service) listClaimedSubnets(ctx context.Context) ([]net.IPNet, error) {
+	existingSubnets, err := s.listSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	owned, err := s.listOwnedSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	for _, subnet := range owned {
+		existingSubnets = append(existingSubnets, subnet)
+	}
+
+	return existingSubnets, nil
+}
+
+// listOwnedSubnets returns the owner index, mapping owners to their subnets.
+func (s *Service) listOwnedSubnets(ctx context.Context) (map[string]net.IPNet, error) {
+	k, err := microstorage.NewK(poolKey(s.pool, ipamOwnerStorageKey))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kvs, err := s.storage.List(ctx, k)
+	if err != nil && !microstorage.IsNotFound(err) {
+		return nil, microerror.Mask(err)
+	}
+
+	owned := map[string]net.IPNet{}
+	for _, kv := range kvs {
+		_, subnet, err := net.ParseCIDR(kv.Val())
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		owned[decodeOwnerKey(kv.Key())] = *subnet
+	}
+
+	return owned, nil
+}
+
+// searchOwnedSubnet returns the subnet of the given owner, or nil if the
+// owner does not have one.
+func (s *Service) searchOwnedSubnet(ctx context.Context, owner string) (*net.IPNet, error) {
+	k, err := microstorage.NewK(encodeOwnerKey(s.pool, owner))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	_, subnet, err := net.ParseCIDR(kv.Val())
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return subnet, nil
+}
+
+// deleteOwners removes the owner index entries of the given subnets.
+func (s *Service) deleteOwners(ctx context.Context, subnets []net.IPNet) error {
+	owned, err := s.listOwnedSubnets(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	for owner, ownedSubnet := range owned {
+		for _, subnet := range subnets {
+			if ipNetEqual(ownedSubnet, subnet) {
+				if err := s.delete(ctx, encodeOwnerKey(s.pool, owner)); err != nil {
+					return microerror.Mask(err)
+				}
+			}
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,172 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestCreateSubnetForOwner tests that CreateSubnetForOwner allocates at most
+// one subnet per owner.
+func TestCreateSubnetForOwner(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	mask := net.CIDRMask(24, 32)
+
+	first, err := service.CreateSubnetForOwner(ctx, "cluster-a", mask, "a", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(first, mustParseCIDR("10.4.0.0/24")) {
+		t.Fatalf("unexpected subnet returned: %v", first.String())
+	}
+
+	// Retrying returns the same subnet.
+	retried, err := service.CreateSubnetForOwner(ctx, "cluster-a", mask, "a", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(retried, first) {
+		t.Fatalf("expected %v, got %v", first.String(), retried.String())
+	}
+
+	// Retrying with a different annotation keeps the stored annotation.
+	retried, err = service.CreateSubnetForOwner(ctx, "cluster-a", mask, "other", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(retried, first) {
+		t.Fatalf("expected %v, got %v", first.String(), retried.String())
+	}
+	stored, err := service.GetSubnet(ctx, first)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting subnet: %v", err)
+	}
+	if stored.Annotation != "a" {
+		t.Fatalf("expected annotation %#q, got %#q", "a", stored.Annotation)
+	}
+
+	second, err := service.CreateSubnetForOwner(ctx, "cluster-b", mask, "b", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(second, mustParseCIDR("10.4.1.0/24")) {
+		t.Fatalf("unexpected subnet returned: %v", second.String())
+	}
+
+	// Requesting a different size for an existing owner fails.
+	_, err = service.CreateSubnetForOwner(ctx, "cluster-a", net.CIDRMask(25, 32), "a", nil)
+	if !IsInvalidParameter(err) {
+		t.Fatalf("expected invalid parameter error, got: %v", err)
+	}
+
+	_, err = service.CreateSubnetForOwner(ctx, "cluster/a", mask, "a", nil)
+	if !IsInvalidParameter(err) {
+		t.Fatalf("expected invalid parameter error, got: %v", err)
+	}
+
+	subnets, err := service.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 2 {
+		t.Fatalf("expected 2 stored subnets, got %v", subnets)
+	}
+
+	// Deleting the subnet releases it for the owner as well.
+	if err := service.DeleteSubnet(ctx, first); err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+
+	third, err := service.CreateSubnetForOwner(ctx, "cluster-c", net.CIDRMask(25, 32), "c", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(third, mustParseCIDR("10.4.0.0/25")) {
+		t.Fatalf("unexpected subnet returned: %v", third.String())
+	}
+
+	again, err := service.CreateSubnetForOwner(ctx, "cluster-a", mask, "a", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(again, mustParseCIDR("10.4.2.0/24")) {
+		t.Fatalf("unexpected subnet returned: %v", again.String())
+	}
+}
+
+// TestCreateSubnetForOwnerPartialWrite tests that an owner index entry,
+// written without its subnet by a failed call, claims the subnet and is
+// completed by a retry.
+func TestCreateSubnetForOwnerPartialWrite(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	kv, err := microstorage.NewKV(encodeOwnerKey("", "cluster-a"), "10.4.0.0/24")
+	if err != nil {
+		t.Fatalf("unexpected error creating kv: %v", err)
+	}
+	if err := storage.Put(ctx, kv); err != nil {
+		t.Fatalf("unexpected error storing kv: %v", err)
+	}
+
+	// The claimed subnet is not handed out to anybody else.
+	other, err := service.CreateSubnet(ctx, net.CIDRMask(24, 32), "other", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(other, mustParseCIDR("10.4.1.0/24")) {
+		t.Fatalf("unexpected subnet returned: %v", other.String())
+	}
+
+	retried, err := service.CreateSubnetForOwner(ctx, "cluster-a", net.CIDRMask(24, 32), "a", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(retried, mustParseCIDR("10.4.0.0/24")) {
+		t.Fatalf("unexpected subnet returned: %v", retried.String())
+	}
+
+	subnet, err := service.GetSubnet(ctx, retried)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting subnet: %v", err)
+	}
+	if subnet.Annotation != "a" {
+		t.Fatalf("expected annotation %#q, got %#q", "a", subnet.Annotation)
+	}
+}
@@ -0,0 +1,135 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"sort"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/micrologger"
+	"github.com/giantswarm/microstorage"
+)
+
+// PoolsConfig represents the configuration used to create a new multi-pool
+// ipam service.
+type PoolsConfig struct {
+	Logger  micrologger.Logger
+	Storage microstorage.Storage
+
+	// Pools maps the names of the pools to their configuration. Logger,
+	// Storage and Pool of each configuration are set by NewPools, so that
+	// all pools share one storage.
+	Pools map[string]Config
+}
+
+// NewPools creates a new configured multi-pool ipam service.
+func NewPools(config PoolsConfig) (*Pools, error) {
+	if config.Logger == nil {
+		return nil, microerror.Maskf(invalidConfigError, "logger must not be empty")
+	}
+	if config.Storage == nil {
+		return nil, microerror.Maskf(invalidConfigError, "storage must not be empty")
+	}
+	if len(config.Pools) == 0 {
+		return nil, microerror.Maskf(invalidConfigError, "pools must not be empty")
+	}
+
+	services := map[string]*Service{}
+	for name, c := range config.Pools {
+		if name == "" {
+			return nil, microerror.Maskf(invalidConfigError, "pool name must not be empty")
+		}
+
+		c.Logger = config.Logger
+		c.Storage = config.Storage
+		c.Pool = name
+
+		service, err := New(c)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		services[name] = service
+	}
+
+	newPools := &Pools{
+		services: services,
+	}
+
+	return newPools, nil
+}
+
+// Pools manages several named pools, each with its own network, within one
+// storage.
+type Pools struct {
+	services map[string]*Service
+}
+
+// Names returns the names of the configured pools in alphabetical order.
+func (p *Pools) Names() []string {
+	var names []string
+	for name := range p.services {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// Pool returns the service managing the pool of the given name. An error
+// matched by IsNotFound is returned when there is no such pool.
+func (p *Pools) Pool(name string) (*Service, error) {
+	service, ok := p.services[name]
+	if !ok {
+		return nil, microerror.Maskf(notFoundError, "pool %#q", name)
+	}
+
+	return service, nil
+}
+
+// CreateSubnet returns an available subnet, of the given size, from the pool
+// of the given name. See Service.CreateSubnet.
+func (p *Pools) CreateSubnet(ctx context.Context, pool string, mask net.IPMask, annotation string, reserved []net.IPNet) (net.IPNet, error) {
+	service, err := p.Pool(pool)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	subnet, err := service.CreateSubnet(ctx, mask, annotation, reserved)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	return subnet, nil
+}
+
+// DeleteSubnet deletes the given subnet from the pool of the given name. See
+// Service.DeleteSubnet.
+func (p *Pools) DeleteSubnet(ctx context.Context, pool string, subnet net.IPNet) error {
+	service, err := p.Pool(pool)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	err = service.DeleteSubnet(ctx, subnet)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// ListSubnets returns the stored subnets of the pool of the given name. See
+// Service.ListSubnets.
+func (p *Pools) ListSubnets(ctx context.Context, pool string) ([]Subnet, error) {
+	service, err := p.Pool(pool)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	subnets, err := service.ListSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return subnets, nil
+}
@@ -0,0 +1,178 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+func Test_NewPools(t *testing.T) {
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	testCases := []struct {
+		name         string
+		config       PoolsConfig
+		errorMatcher func(error) bool
+	}{
+		{
+			name: "case 0: valid pools",
+			config: PoolsConfig{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+				Pools: map[string]Config{
+					"infra":       {Network: &network},
+					"workload-eu": {Network: &network},
+				},
+			},
+		},
+		{
+			name: "case 1: no pools",
+			config: PoolsConfig{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+			},
+			errorMatcher: IsInvalidConfig,
+		},
+		{
+			name: "case 2: empty pool name",
+			config: PoolsConfig{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+				Pools: map[string]Config{
+					"": {Network: &network},
+				},
+			},
+			errorMatcher: IsInvalidConfig,
+		},
+		{
+			name: "case 3: pool name with slashes",
+			config: PoolsConfig{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+				Pools: map[string]Config{
+					"workload/eu": {Network: &network},
+				},
+			},
+			errorMatcher: IsInvalidConfig,
+		},
+		{
+			name: "case 4: pool without network",
+			config: PoolsConfig{
+				Logger:  microloggertest.New(),
+				Storage: storage,
+				Pools: map[string]Config{
+					"infra": {},
+				},
+			},
+			errorMatcher: IsInvalidConfig,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := NewPools(tc.config)
+
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.errorMatcher(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+		})
+	}
+}
+
+func Test_Pools(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	// The pools deliberately share a network, to show that they are
+	// independent of each other.
+	network := mustParseCIDR("10.4.0.0/16")
+
+	pools, err := NewPools(PoolsConfig{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Pools: map[string]Config{
+			"workload-eu": {Network: &network},
+			"infra":       {Network: &network},
+		},
+	})
+	if err != nil {
+		t.Fatalf("error == %#v, want nil", err)
+	}
+
+	if names := pools.Names(); len(names) != 2 || names[0] != "infra" || names[1] != "workload-eu" {
+		t.Fatalf("got %v, want [infra workload-eu]", names)
+	}
+
+	mask := net.CIDRMask(24, 32)
+
+	steps := []struct {
+		pool     string
+		expected string
+	}{
+		{pool: "workload-eu", expected: "10.4.0.0/24"},
+		{pool: "workload-eu", expected: "10.4.1.0/24"},
+		{pool: "infra", expected: "10.4.0.0/24"},
+	}
+	for _, step := range steps {
+		subnet, err := pools.CreateSubnet(ctx, step.pool, mask, step.pool, nil)
+		if err != nil {
+			t.Fatalf("error == %#v, want nil", err)
+		}
+		if !ipNetEqual(subnet, mustParseCIDR(step.expected)) {
+			t.Fatalf("got %q, want %q", subnet.String(), step.expected)
+		}
+	}
+
+	subnets, err := pools.ListSubnets(ctx, "workload-eu")
+	if err != nil {
+		t.Fatalf("error == %#v, want nil", err)
+	}
+	if len(subnets) != 2 {
+		t.Fatalf("got %v, want 2 subnets", subnets)
+	}
+
+	err = pools.DeleteSubnet(ctx, "infra", mustParseCIDR("10.4.0.0/24"))
+	if err != nil {
+		t.Fatalf("error == %#v, want nil", err)
+	}
+
+	subnets, err = pools.ListSubnets(ctx, "infra")
+	if err != nil {
+		t.Fatalf("error == %#v, want nil", err)
+	}
+	if len(subnets) != 0 {
+		t.Fatalf("got %v, want no subnets", subnets)
+	}
+
+	subnets, err = pools.ListSubnets(ctx, "workload-eu")
+	if err != nil {
+		t.Fatalf("error == %#v, want nil", err)
+	}
+	if len(subnets) != 2 {
+		t.Fatalf("got %v, want 2 subnets", subnets)
+	}
+
+	_, err = pools.CreateSubnet(ctx, "workload-us", mask, "", nil)
+	if !IsNotFound(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+}
@@ -0,0 +1,140 @@
+package ipam
+
+import (
+	"math/big"
+	"net"
+
+	"github.com/giantswarm/microerror"
+)
+
+// Profile describes which addresses of a subnet can be used by hosts. Cloud
+// providers reserve addresses at the start and at the end of every subnet,
+// e.g. for the router and for DNS.
+type Profile struct {
+	// Name identifies the profile, see LookupProfile.
+	Name string
+	// ReservedFirst is the number of addresses reserved at the start of
+	// every IPv4 subnet, including the network address.
+	ReservedFirst int
+	// ReservedLast is the number of addresses reserved at the end of every
+	// IPv4 subnet, including the broadcast address.
+	ReservedLast int
+	// IPv6ReservedFirst is the number of addresses reserved at the start of
+	// every IPv6 subnet.
+	IPv6ReservedFirst int
+	// IPv6ReservedLast is the number of addresses reserved at the end of
+	// every IPv6 subnet.
+	IPv6ReservedLast int
+	// PointToPoint makes all addresses of subnets with at most two
+	// addresses usable, e.g. of /31 and /32 IPv4 subnets, see RFC 3021.
+	PointToPoint bool
+}
+
+var (
+	// ProfilePlain reserves the network address of every subnet, and the
+	// broadcast address of IPv4 subnets, except for point-to-point subnets.
+	ProfilePlain = Profile{
+		Name:              "plain",
+		ReservedFirst:     1,
+		ReservedLast:      1,
+		IPv6ReservedFirst: 1,
+		IPv6ReservedLast:  0,
+		PointToPoint:      true,
+	}
+	// ProfileAWS reserves the first four and the last address of every
+	// subnet, i.e. the network address, the VPC router, the DNS server, an
+	// address reserved for future use, and the broadcast address.
+	ProfileAWS = Profile{
+		Name:              "aws",
+		ReservedFirst:     4,
+		ReservedLast:      1,
+		IPv6ReservedFirst: 4,
+		IPv6ReservedLast:  1,
+	}
+	// ProfileAzure reserves the first four and the last address of every
+	// subnet, i.e. the network address, the default gateway, two addresses
+	// mapping the Azure DNS, and the broadcast address.
+	ProfileAzure = Profile{
+		Name:              "azure",
+		ReservedFirst:     4,
+		ReservedLast:      1,
+		IPv6ReservedFirst: 4,
+		IPv6ReservedLast:  1,
+	}
+	// ProfileGCP reserves the first two and the last two addresses of every
+	// subnet, i.e. the network address, the default gateway, an address
+	// reserved for future use, and the broadcast address.
+	ProfileGCP = Profile{
+		Name:              "gcp",
+		ReservedFirst:     2,
+		ReservedLast:      2,
+		IPv6ReservedFirst: 2,
+		IPv6ReservedLast:  2,
+	}
+)
+
+// LookupProfile returns the profile of the given name, i.e. aws, azure, gcp
+// or plain. The empty name refers to the plain profile. An error matched by
+// IsNotFound is returned for unknown names.
+func LookupProfile(name string) (Profile, error) {
+	switch name {
+	case "", ProfilePlain.Name:
+		return ProfilePlain, nil
+	case ProfileAWS.Name:
+		return ProfileAWS, nil
+	case ProfileAzure.Name:
+		return ProfileAzure, nil
+	case ProfileGCP.Name:
+		return ProfileGCP, nil
+	}
+
+	return Profile{}, microerror.Maskf(notFoundError, "profile %#q", name)
+}
+
+// Contains returns true when the given address is a usable address of the
+// given subnet, false otherwise.
+func (p Profile) Contains(subnet net.IPNet, ip net.IP) bool {
+	start, end, ok := p.UsableRange(subnet)
+	if !ok {
+		return false
+	}
+
+	return compareIP(start, ip) <= 0 && compareIP(ip, end) <= 0
+}
+
+// UsableCount returns the number of usable addresses of the given subnet.
+func (p Profile) UsableCount(subnet net.IPNet) *big.Int {
+	start, end, ok := p.UsableRange(subnet)
+	if !ok {
+		return big.NewInt(0)
+	}
+
+	count := ipToDecimal(end)
+	count.Sub(count, ipToDecimal(start))
+
+	return count.Add(count, big.NewInt(1))
+}
+
+// UsableRange returns the first and the last usable address of the given
+// subnet, and false when the subnet has no usable addresses.
+// e.g: aws, 10.4.0.0/24 -> 10.4.0.4, 10.4.0.254
+func (p Profile) UsableRange(subnet net.IPNet) (start, end net.IP, ok bool) {
+	start, end = CIDRToRange(subnet)
+
+	ones, bits := subnet.Mask.Size()
+	if p.PointToPoint && bits-ones < 2 {
+		return start, end, true
+	}
+
+	first, last := p.ReservedFirst, p.ReservedLast
+	if ipLength(start) == net.IPv6len {
+		first, last = p.IPv6ReservedFirst, p.IPv6ReservedLast
+	}
+
+	reserved := big.NewInt(int64(first + last))
+	if size(subnet.Mask).Cmp(reserved) <= 0 {
+		return nil, nil, false
+	}
+
+	return add(start, first), add(end, -last), true
+}
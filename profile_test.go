@@ -0,0 +1,222 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestProfileUsableRange tests the usable addresses of example subnets, as
+// documented by the cloud providers.
+func TestProfileUsableRange(t *testing.T) {
+	tests := []struct {
+		profile       string
+		subnet        string
+		expectedStart string
+		expectedEnd   string
+		expectedCount string
+	}{
+		{
+			profile:       "plain",
+			subnet:        "10.4.0.0/24",
+			expectedStart: "10.4.0.1",
+			expectedEnd:   "10.4.0.254",
+			expectedCount: "254",
+		},
+		{
+			profile:       "plain",
+			subnet:        "10.4.0.8/31",
+			expectedStart: "10.4.0.8",
+			expectedEnd:   "10.4.0.9",
+			expectedCount: "2",
+		},
+		{
+			profile:       "plain",
+			subnet:        "10.4.0.8/32",
+			expectedStart: "10.4.0.8",
+			expectedEnd:   "10.4.0.8",
+			expectedCount: "1",
+		},
+		{
+			profile:       "",
+			subnet:        "fd00::/64",
+			expectedStart: "fd00::1",
+			expectedEnd:   "fd00::ffff:ffff:ffff:ffff",
+			expectedCount: "18446744073709551615",
+		},
+		// AWS reserves 10.0.0.0 to 10.0.0.3 and 10.0.0.255 of 10.0.0.0/24.
+		{
+			profile:       "aws",
+			subnet:        "10.0.0.0/24",
+			expectedStart: "10.0.0.4",
+			expectedEnd:   "10.0.0.254",
+			expectedCount: "251",
+		},
+		// /28 is the smallest subnet allowed by AWS.
+		{
+			profile:       "aws",
+			subnet:        "10.0.0.16/28",
+			expectedStart: "10.0.0.20",
+			expectedEnd:   "10.0.0.30",
+			expectedCount: "11",
+		},
+		{
+			profile:       "aws",
+			subnet:        "10.0.0.0/30",
+			expectedCount: "0",
+		},
+		{
+			profile:       "aws",
+			subnet:        "2600:1f14::/64",
+			expectedStart: "2600:1f14::4",
+			expectedEnd:   "2600:1f14::ffff:ffff:ffff:fffe",
+			expectedCount: "18446744073709551611",
+		},
+		// Azure reserves x.x.x.0 to x.x.x.3 and x.x.x.255 of a /24.
+		{
+			profile:       "azure",
+			subnet:        "10.1.0.0/24",
+			expectedStart: "10.1.0.4",
+			expectedEnd:   "10.1.0.254",
+			expectedCount: "251",
+		},
+		// /29 is the smallest subnet allowed by Azure.
+		{
+			profile:       "azure",
+			subnet:        "10.1.0.8/29",
+			expectedStart: "10.1.0.12",
+			expectedEnd:   "10.1.0.14",
+			expectedCount: "3",
+		},
+		// GCP reserves the network, gateway, second-to-last and broadcast
+		// addresses, e.g. of the default us-central1 subnet.
+		{
+			profile:       "gcp",
+			subnet:        "10.128.0.0/20",
+			expectedStart: "10.128.0.2",
+			expectedEnd:   "10.128.15.253",
+			expectedCount: "4092",
+		},
+		{
+			profile:       "gcp",
+			subnet:        "10.128.0.0/29",
+			expectedStart: "10.128.0.2",
+			expectedEnd:   "10.128.0.5",
+			expectedCount: "4",
+		},
+	}
+
+	for index, test := range tests {
+		profile, err := LookupProfile(test.profile)
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned looking up profile: %v", index, err)
+		}
+
+		start, end, ok := profile.UsableRange(mustParseCIDR(test.subnet))
+		if ok != (test.expectedStart != "") {
+			t.Fatalf("%v: expected usable addresses %v, got %v", index, test.expectedStart != "", ok)
+		}
+		if ok && (start.String() != test.expectedStart || end.String() != test.expectedEnd) {
+			t.Fatalf("%v: expected usable range %v-%v, got %v-%v", index, test.expectedStart, test.expectedEnd, start, end)
+		}
+
+		count := profile.UsableCount(mustParseCIDR(test.subnet))
+		if count.String() != test.expectedCount {
+			t.Fatalf("%v: expected %v usable addresses, got %v", index, test.expectedCount, count)
+		}
+	}
+}
+
+// TestProfileContains tests the Contains method of Profile.
+func TestProfileContains(t *testing.T) {
+	tests := []struct {
+		profile  Profile
+		subnet   string
+		ip       string
+		expected bool
+	}{
+		{profile: ProfileAWS, subnet: "10.0.0.0/24", ip: "10.0.0.3", expected: false},
+		{profile: ProfileAWS, subnet: "10.0.0.0/24", ip: "10.0.0.4", expected: true},
+		{profile: ProfileAWS, subnet: "10.0.0.0/24", ip: "10.0.0.254", expected: true},
+		{profile: ProfileAWS, subnet: "10.0.0.0/24", ip: "10.0.0.255", expected: false},
+		{profile: ProfileAWS, subnet: "10.0.0.0/24", ip: "10.0.1.4", expected: false},
+		{profile: ProfileGCP, subnet: "10.128.0.0/20", ip: "10.128.15.253", expected: true},
+		{profile: ProfileGCP, subnet: "10.128.0.0/20", ip: "10.128.15.254", expected: false},
+		{profile: ProfilePlain, subnet: "10.4.0.0/24", ip: "fd00::1", expected: false},
+	}
+
+	for index, test := range tests {
+		contains := test.profile.Contains(mustParseCIDR(test.subnet), net.ParseIP(test.ip))
+		if contains != test.expected {
+			t.Fatalf("%v: expected %v, got %v", index, test.expected, contains)
+		}
+	}
+}
+
+// TestHostAllocatorProfile tests that host allocators only allocate the
+// usable addresses of the configured profile.
+func TestHostAllocatorProfile(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	subnet := mustParseCIDR("10.0.0.16/29")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &subnet,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+	err = service.CreateSubnetWithCIDR(ctx, subnet, "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	allocator, err := NewHostAllocator(HostAllocatorConfig{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Subnet:  &subnet,
+		Profile: "aws",
+	})
+	if err != nil {
+		t.Fatalf("error returned creating host allocator: %v", err)
+	}
+
+	for _, expected := range []string{"10.0.0.20", "10.0.0.21", "10.0.0.22"} {
+		ip, err := allocator.Allocate(ctx, "")
+		if err != nil {
+			t.Fatalf("unexpected error returned allocating address: %v", err)
+		}
+		if ip.String() != expected {
+			t.Fatalf("expected address %v, got %v", expected, ip.String())
+		}
+	}
+
+	_, err = allocator.Allocate(ctx, "")
+	if !IsSpaceExhausted(err) {
+		t.Fatalf("expected space exhausted error, got %v", err)
+	}
+
+	_, err = LookupProfile("openstack")
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error, got %v", err)
+	}
+	_, err = NewHostAllocator(HostAllocatorConfig{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Subnet:  &subnet,
+		Profile: "openstack",
+	})
+	if !IsInvalidConfig(err) {
+		t.Fatalf("expected invalid config error, got %v", err)
+	}
+}
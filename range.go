@@ -0,0 +1,110 @@
+package ipam
+
+import (
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/giantswarm/microerror"
+)
+
+// CIDRToRange returns the first and the last IP of the given network.
+// e.g: 10.4.0.0/22 -> 10.4.0.0, 10.4.3.255
+func CIDRToRange(network net.IPNet) (start, end net.IP) {
+	network.IP = network.IP.Mask(network.Mask)
+	r := newIPRange(network)
+
+	return r.start, r.end
+}
+
+// ParseRange parses a range of IPs in the form `start-end`, e.g.
+// `10.20.0.5-10.20.3.200`. Both IPs are part of the range. The returned
+// error is matched by IsInvalidParameter when the range is malformed, when
+// its IPs are of different address families, or when start is higher than
+// end.
+func ParseRange(s string) (start, end net.IP, err error) {
+	parts := strings.Split(s, "-")
+	if len(parts) != 2 {
+		return nil, nil, microerror.Maskf(invalidParameterError, "range %#q must be of the form start-end", s)
+	}
+
+	start = net.ParseIP(strings.TrimSpace(parts[0]))
+	end = net.ParseIP(strings.TrimSpace(parts[1]))
+	if start == nil || end == nil {
+		return nil, nil, microerror.Maskf(invalidParameterError, "range %#q must consist of two IPs", s)
+	}
+	if ipLength(start) != ipLength(end) {
+		return nil, nil, microerror.Maskf(invalidParameterError, "range %#q must not mix address families", s)
+	}
+	if compareIP(start, end) > 0 {
+		return nil, nil, microerror.Maskf(invalidParameterError, "range %#q must not end before it starts", s)
+	}
+
+	length := ipLength(start)
+	start = decimalToIP(ipToDecimal(start), length)
+	end = decimalToIP(ipToDecimal(end), length)
+
+	return start, end, nil
+}
+
+// ParseRangeCIDRs parses a range of IPs like ParseRange, and returns the
+// minimal list of networks covering it, e.g. to be passed as
+// Config.AllocatedSubnets or as reserved subnets.
+// e.g: 10.20.0.5-10.20.0.16 -> [10.20.0.5/32, 10.20.0.6/31, 10.20.0.8/29, 10.20.0.16/32]
+func ParseRangeCIDRs(s string) ([]net.IPNet, error) {
+	start, end, err := ParseRange(s)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return RangeToCIDRs(start, end), nil
+}
+
+// RangeToCIDRs returns the minimal sorted list of networks covering exactly
+// the IPs from start to end, both included. It returns nil when the IPs are
+// of different address families, or when start is higher than end.
+func RangeToCIDRs(start, end net.IP) []net.IPNet {
+	if start == nil || end == nil || ipLength(start) != ipLength(end) || compareIP(start, end) > 0 {
+		return nil
+	}
+
+	return rangeToCIDRs(ipRange{start: start, end: end})
+}
+
+// rangeToCIDRs returns the minimal sorted list of networks covering exactly
+// the addresses of the given range.
+func rangeToCIDRs(r ipRange) []net.IPNet {
+	length := ipLength(r.start)
+	bits := uint(length * 8)
+
+	start := ipToDecimal(r.start)
+	end := ipToDecimal(r.end)
+
+	var networks []net.IPNet
+	for start.Cmp(end) <= 0 {
+		// The largest network starting at start is limited by the alignment
+		// of start, and by the end of the range.
+		hostBits := start.TrailingZeroBits()
+		if start.Sign() == 0 || hostBits > bits {
+			hostBits = bits
+		}
+		for {
+			last := new(big.Int).Lsh(big.NewInt(1), hostBits)
+			last.Add(last, start)
+			last.Sub(last, big.NewInt(1))
+			if last.Cmp(end) <= 0 {
+				break
+			}
+			hostBits--
+		}
+
+		networks = append(networks, net.IPNet{
+			IP:   decimalToIP(start, length),
+			Mask: net.CIDRMask(int(bits-hostBits), int(bits)),
+		})
+
+		start.Add(start, new(big.Int).Lsh(big.NewInt(1), hostBits))
+	}
+
+	return networks
+}
@@ -0,0 +1,177 @@
+package ipam
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+// TestRangeToCIDRs tests the RangeToCIDRs function.
+func TestRangeToCIDRs(t *testing.T) {
+	tests := []struct {
+		start         string
+		end           string
+		expectedCIDRs []string
+	}{
+		{
+			start:         "10.20.0.5",
+			end:           "10.20.3.200",
+			expectedCIDRs: []string{"10.20.0.5/32", "10.20.0.6/31", "10.20.0.8/29", "10.20.0.16/28", "10.20.0.32/27", "10.20.0.64/26", "10.20.0.128/25", "10.20.1.0/24", "10.20.2.0/24", "10.20.3.0/25", "10.20.3.128/26", "10.20.3.192/29", "10.20.3.200/32"},
+		},
+		{
+			start:         "10.4.0.0",
+			end:           "10.4.255.255",
+			expectedCIDRs: []string{"10.4.0.0/16"},
+		},
+		{
+			start:         "10.4.0.1",
+			end:           "10.4.0.1",
+			expectedCIDRs: []string{"10.4.0.1/32"},
+		},
+		{
+			start:         "0.0.0.0",
+			end:           "255.255.255.255",
+			expectedCIDRs: []string{"0.0.0.0/0"},
+		},
+		{
+			start:         "fd00::1",
+			end:           "fd00::ffff",
+			expectedCIDRs: []string{"fd00::1/128", "fd00::2/127", "fd00::4/126", "fd00::8/125", "fd00::10/124", "fd00::20/123", "fd00::40/122", "fd00::80/121", "fd00::100/120", "fd00::200/119", "fd00::400/118", "fd00::800/117", "fd00::1000/116", "fd00::2000/115", "fd00::4000/114", "fd00::8000/113"},
+		},
+		// Invalid ranges return nil.
+		{
+			start: "10.4.0.2",
+			end:   "10.4.0.1",
+		},
+		{
+			start: "10.4.0.1",
+			end:   "fd00::1",
+		},
+	}
+
+	for index, test := range tests {
+		cidrs := RangeToCIDRs(net.ParseIP(test.start), net.ParseIP(test.end))
+
+		if test.expectedCIDRs == nil {
+			if cidrs != nil {
+				t.Fatalf("%v: expected nil, got %v", index, cidrStrings(cidrs))
+			}
+			continue
+		}
+
+		if !reflect.DeepEqual(cidrStrings(cidrs), test.expectedCIDRs) {
+			t.Fatalf("%v: expected %v, got %v", index, test.expectedCIDRs, cidrStrings(cidrs))
+		}
+
+		// Converting the networks back to ranges yields the original range.
+		start, _ := CIDRToRange(cidrs[0])
+		_, end := CIDRToRange(cidrs[len(cidrs)-1])
+		if !start.Equal(net.ParseIP(test.start)) || !end.Equal(net.ParseIP(test.end)) {
+			t.Fatalf("%v: expected range %v-%v, got %v-%v", index, test.start, test.end, start, end)
+		}
+	}
+}
+
+// TestCIDRToRange tests the CIDRToRange function.
+func TestCIDRToRange(t *testing.T) {
+	tests := []struct {
+		network       net.IPNet
+		expectedStart string
+		expectedEnd   string
+	}{
+		{
+			network:       mustParseCIDR("10.4.0.0/22"),
+			expectedStart: "10.4.0.0",
+			expectedEnd:   "10.4.3.255",
+		},
+		{
+			network:       net.IPNet{IP: net.ParseIP("10.4.1.7"), Mask: net.CIDRMask(22, 32)},
+			expectedStart: "10.4.0.0",
+			expectedEnd:   "10.4.3.255",
+		},
+		{
+			network:       mustParseCIDR("fd00::/64"),
+			expectedStart: "fd00::",
+			expectedEnd:   "fd00::ffff:ffff:ffff:ffff",
+		},
+	}
+
+	for index, test := range tests {
+		start, end := CIDRToRange(test.network)
+
+		if start.String() != test.expectedStart || end.String() != test.expectedEnd {
+			t.Fatalf("%v: expected %v-%v, got %v-%v", index, test.expectedStart, test.expectedEnd, start, end)
+		}
+	}
+}
+
+// TestParseRange tests the ParseRange and ParseRangeCIDRs functions.
+func TestParseRange(t *testing.T) {
+	tests := []struct {
+		name                 string
+		input                string
+		expectedCIDRs        []string
+		expectedErrorHandler func(error) bool
+	}{
+		{
+			name:          "case 0: parse an ipv4 range",
+			input:         "10.20.0.5-10.20.0.16",
+			expectedCIDRs: []string{"10.20.0.5/32", "10.20.0.6/31", "10.20.0.8/29", "10.20.0.16/32"},
+		},
+		{
+			name:          "case 1: parse a range with spaces",
+			input:         "10.20.0.0 - 10.20.0.255",
+			expectedCIDRs: []string{"10.20.0.0/24"},
+		},
+		{
+			name:          "case 2: parse an ipv6 range",
+			input:         "fd00::-fd00::3",
+			expectedCIDRs: []string{"fd00::/126"},
+		},
+		{
+			name:                 "case 3: parse a single ip",
+			input:                "10.20.0.5",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 4: parse an invalid ip",
+			input:                "10.20.0.5-10.20.0.256",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 5: parse a reversed range",
+			input:                "10.20.0.5-10.20.0.4",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+		{
+			name:                 "case 6: parse a range mixing address families",
+			input:                "10.20.0.5-fd00::1",
+			expectedErrorHandler: IsInvalidParameter,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			cidrs, err := ParseRangeCIDRs(tc.input)
+
+			switch {
+			case err == nil && tc.expectedErrorHandler == nil:
+				// correct; carry on
+			case err != nil && tc.expectedErrorHandler == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.expectedErrorHandler != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.expectedErrorHandler(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.expectedErrorHandler != nil {
+				return
+			}
+
+			if !reflect.DeepEqual(cidrStrings(cidrs), tc.expectedCIDRs) {
+				t.Fatalf("cidrs == %v, want %v", cidrStrings(cidrs), tc.expectedCIDRs)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package ipam
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/giantswarm/microerror"
+)
+
+// recordAPIVersion identifies the current version of the record format
+// subnets are stored in.
+const recordAPIVersion = "ipam.giantswarm.io/v1"
+
+// record is the value stored under the storage key of a subnet.
+type record struct {
+	APIVersion string            `json:"apiVersion"`
+	Annotation string            `json:"annotation,omitempty"`
+	Labels     map[string]string `json:"labels,omitempty"`
+}
+
+// encodeRecord returns the value stored for a subnet with the given
+// annotation and labels. Subnets without labels are stored as their plain
+// annotation, as done by earlier versions, so that those versions can still
+// read them. Annotations which would be mistaken for a record are stored as a
+// record.
+func encodeRecord(annotation string, labels map[string]string) (string, error) {
+	if len(labels) == 0 {
+		r := decodeRecord(annotation)
+		if r.Annotation == annotation && len(r.Labels) == 0 {
+			return annotation, nil
+		}
+	}
+
+	r := record{
+		APIVersion: recordAPIVersion,
+		Annotation: annotation,
+		Labels:     labels,
+	}
+	b, err := json.Marshal(r)
+	if err != nil {
+		return "", microerror.Mask(err)
+	}
+
+	return string(b), nil
+}
+
+// decodeRecord returns the record stored for a subnet. Values which are not
+// a record of a known version, e.g. those written by earlier versions, are
+// returned as the annotation of the record.
+func decodeRecord(val string) record {
+	if strings.HasPrefix(val, "{") {
+		var r record
+		err := json.Unmarshal([]byte(val), &r)
+		if err == nil && r.APIVersion == recordAPIVersion {
+			return r
+		}
+	}
+
+	return record{Annotation: val}
+}
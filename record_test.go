@@ -0,0 +1,58 @@
+package ipam
+
+import (
+	"reflect"
+	"testing"
+)
+
+// TestRecord tests that encodeRecord and decodeRecord round trip, and that
+// values written by earlier versions are read as annotations.
+func TestRecord(t *testing.T) {
+	tests := []struct {
+		annotation  string
+		labels      map[string]string
+		expectedVal string
+	}{
+		{
+			annotation:  "cluster-a",
+			expectedVal: "cluster-a",
+		},
+		{
+			annotation:  "",
+			expectedVal: "",
+		},
+		// Annotations packed with JSON by hand are kept as they are.
+		{
+			annotation:  `{"cluster":"a8f3k"}`,
+			expectedVal: `{"cluster":"a8f3k"}`,
+		},
+		// Annotations which look like a record are stored as a record.
+		{
+			annotation:  `{"apiVersion":"ipam.giantswarm.io/v1"}`,
+			expectedVal: `{"apiVersion":"ipam.giantswarm.io/v1","annotation":"{\"apiVersion\":\"ipam.giantswarm.io/v1\"}"}`,
+		},
+		{
+			annotation:  "cluster-a",
+			labels:      map[string]string{"cluster": "a8f3k"},
+			expectedVal: `{"apiVersion":"ipam.giantswarm.io/v1","annotation":"cluster-a","labels":{"cluster":"a8f3k"}}`,
+		},
+	}
+
+	for index, test := range tests {
+		val, err := encodeRecord(test.annotation, test.labels)
+		if err != nil {
+			t.Fatalf("%v: unexpected error returned encoding record: %v", index, err)
+		}
+		if val != test.expectedVal {
+			t.Fatalf("%v: val == %v, want %v", index, val, test.expectedVal)
+		}
+
+		r := decodeRecord(val)
+		if r.Annotation != test.annotation {
+			t.Fatalf("%v: annotation == %v, want %v", index, r.Annotation, test.annotation)
+		}
+		if !reflect.DeepEqual(r.Labels, test.labels) {
+			t.Fatalf("%v: labels == %v, want %v", index, r.Labels, test.labels)
+		}
+	}
+}
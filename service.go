@@ -4,6 +4,9 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"sort"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/giantswarm/microerror"
@@ -12,7 +15,17 @@ import (
 )
 
 const (
-	ipamSubnetStorageKey = "/ipam/subnet"
+	ipamStorageKey        = "/ipam"
+	ipamChildStorageKey   = "/ipam/child"
+	ipamExpiryStorageKey  = "/ipam/expiry"
+	ipamHostStorageKey    = "/ipam/host"
+	ipamLockStorageKey    = "/ipam/lock"
+	ipamNetworkStorageKey = "/ipam/network"
+	ipamOwnerStorageKey   = "/ipam/owner"
+	ipamPairStorageKey    = "/ipam/pair"
+	ipamParentStorageKey  = "/ipam/parent"
+	ipamPoolStorageKey    = "/ipam/pool"
+	ipamSubnetStorageKey  = "/ipam/subnet"
 )
 
 // Config represents the configuration used to create a new ipam service.
@@ -20,12 +33,43 @@ type Config struct {
 	Logger  micrologger.Logger
 	Storage microstorage.Storage
 
+	// Pool is the name of the pool managed by the service. The subnets of
+	// each pool are stored under their own storage keys, so that services
+	// of several pools can share one storage. Defaults to the unnamed pool.
+	Pool string
 	// Network is the network in which all returned subnets should exist.
 	Network *net.IPNet
-	// AllocatedSubnets is a list of subnets, contained by `Network`,
-	// that have already been allocated outside of IPAM control.
+	// IPv6Network is an optional IPv6 network. When it is set, the service
+	// runs in dual-stack mode, `Network` must be an IPv4 network and
+	// CreateDualStackSubnet returns pairs of subnets from both networks.
+	IPv6Network *net.IPNet
+	// AllocatedSubnets is a list of subnets, contained by `Network` or
+	// `IPv6Network`, that have already been allocated outside of IPAM control.
 	// Any subnets created by the IPAM service will not overlap with these subnets.
 	AllocatedSubnets []net.IPNet
+	// Excluded is a list of ranges which must never be allocated, e.g.
+	// 172.17.0.0/16 used by Docker. Unlike `AllocatedSubnets`, they may
+	// overlap with the networks in any way, only the overlapping part is
+	// excluded.
+	Excluded []net.IPNet
+	// Strategy decides where within the free space of the network subnets
+	// are allocated. Defaults to FirstFit.
+	Strategy Strategy
+	// Clock returns the current time, against which the expiry of subnets
+	// created with CreateSubnetWithTTL, and of the storage lock, is checked.
+	// Defaults to time.Now.
+	Clock func() time.Time
+	// Profile is the name of the profile deciding which addresses of the
+	// subnets are usable by hosts, as reported by Stats, see LookupProfile.
+	// Defaults to plain.
+	Profile string
+	// StorageLock serialises allocations across processes sharing the same
+	// storage with a lease stored under a lock key. Without it, allocations
+	// are only serialised within this process. The storage does not offer an
+	// atomic compare-and-set, so the lease is best-effort: processes whose
+	// writes to the storage are delayed may still allocate the same subnet.
+	// Acquiring the lease takes a few milliseconds per call.
+	StorageLock bool
 }
 
 // New creates a new configured ipam service.
@@ -37,27 +81,64 @@ func New(config Config) (*Service, error) {
 		return nil, microerror.Maskf(invalidConfigError, "storage must not be empty")
 	}
 
+	if strings.Contains(config.Pool, "/") {
+		return nil, microerror.Maskf(invalidConfigError, "pool %#q must not contain slashes", config.Pool)
+	}
 	if config.Network == nil {
 		return nil, microerror.Maskf(invalidConfigError, "network must not be empty")
 	}
+	if config.IPv6Network != nil {
+		if config.Network.IP.To4() == nil {
+			return nil, microerror.Maskf(invalidConfigError, "network (%v) must be an IPv4 network in dual-stack mode", config.Network.String())
+		}
+		if config.IPv6Network.IP.To4() != nil {
+			return nil, microerror.Maskf(invalidConfigError, "ipv6 network (%v) must be an IPv6 network", config.IPv6Network.String())
+		}
+	}
 	for _, allocatedSubnet := range config.AllocatedSubnets {
-		ipRange := newIPRange(allocatedSubnet)
-		if !(config.Network.Contains(ipRange.start) && config.Network.Contains(ipRange.end)) {
-			return nil, microerror.Maskf(
-				invalidConfigError,
-				"allocated subnet (%v) must be contained by network (%v)",
-				allocatedSubnet.String(),
-				config.Network.String(),
-			)
+		if Contains(*config.Network, allocatedSubnet) {
+			continue
+		}
+		if config.IPv6Network != nil && Contains(*config.IPv6Network, allocatedSubnet) {
+			continue
 		}
+
+		return nil, microerror.Maskf(
+			invalidConfigError,
+			"allocated subnet (%v) must be contained by network (%v)",
+			allocatedSubnet.String(),
+			config.Network.String(),
+		)
+	}
+
+	profile, err := LookupProfile(config.Profile)
+	if IsNotFound(err) {
+		return nil, microerror.Maskf(invalidConfigError, "profile %#q is unknown", config.Profile)
+	} else if err != nil {
+		return nil, microerror.Mask(err)
 	}
 
 	newService := &Service{
 		logger:  config.Logger,
 		storage: config.Storage,
 
+		pool:             config.Pool,
 		network:          *config.Network,
+		ipv6Network:      config.IPv6Network,
 		allocatedSubnets: config.AllocatedSubnets,
+		excluded:         config.Excluded,
+		strategy:         config.Strategy,
+		clock:            config.Clock,
+		profile:          profile,
+		storageLock:      config.StorageLock,
+
+		mutex: poolMutex(config.Storage, config.Pool),
+	}
+	if newService.strategy == nil {
+		newService.strategy = FirstFit{}
+	}
+	if newService.clock == nil {
+		newService.clock = time.Now
 	}
 
 	return newService, nil
@@ -67,15 +148,31 @@ type Service struct {
 	logger  micrologger.Logger
 	storage microstorage.Storage
 
+	pool             string
 	network          net.IPNet
+	ipv6Network      *net.IPNet
 	allocatedSubnets []net.IPNet
+	excluded         []net.IPNet
+	strategy         Strategy
+	clock            func() time.Time
+	profile          Profile
+	storageLock      bool
+	// parent is the delegation of a child pool, see Delegate.
+	parent *delegation
+
+	// mutex serialises allocations of the pool within this process, see
+	// lock.
+	mutex *sync.Mutex
+	// lockOwner identifies the storage lock while it is held, see lock.
+	lockOwner string
 }
 
-// listSubnets retrieves the stored subnets from storage and returns them.
-func (s *Service) listSubnets(ctx context.Context) ([]net.IPNet, error) {
+// ListSubnets retrieves the stored subnets, along with their annotations,
+// from storage and returns them ordered by network.
+func (s *Service) ListSubnets(ctx context.Context) ([]Subnet, error) {
 	s.logger.LogCtx(ctx, "level", "info", "message", "listing subnets")
 
-	k, err := microstorage.NewK(ipamSubnetStorageKey)
+	k, err := microstorage.NewK(poolKey(s.pool, ipamSubnetStorageKey))
 	if err != nil {
 		return nil, microerror.Mask(err)
 	}
@@ -84,7 +181,12 @@ func (s *Service) listSubnets(ctx context.Context) ([]net.IPNet, error) {
 		return nil, microerror.Mask(err)
 	}
 
-	existingSubnets := []net.IPNet{}
+	expiries, err := s.listExpiries(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	existingSubnets := []Subnet{}
 	for _, kv := range kvs {
 		existingSubnetString := decodeKey(kv.Key())
 
@@ -92,62 +194,573 @@ func (s *Service) listSubnets(ctx context.Context) ([]net.IPNet, error) {
 		if err != nil {
 			return nil, microerror.Mask(err)
 		}
-		existingSubnets = append(existingSubnets, *existingSubnet)
+		r := decodeRecord(kv.Val())
+		existingSubnets = append(existingSubnets, Subnet{
+			Network:    *existingSubnet,
+			Annotation: r.Annotation,
+			Labels:     r.Labels,
+			Expires:    expiries[existingSubnet.String()],
+		})
 	}
 
-	subnetCounter.Set(float64(len(existingSubnets)))
+	sort.Sort(subnetsByNetwork(existingSubnets))
+
+	subnetCounter.WithLabelValues(s.pool).Set(float64(len(existingSubnets)))
 
 	return existingSubnets, nil
 }
 
-// CreateSubnet returns the next available subnet, of the configured size,
-// from the configured network.
+// GetSubnet returns the stored subnet equal to the given network. An error
+// matched by IsNotFound is returned when the subnet is not stored.
+func (s *Service) GetSubnet(ctx context.Context, network net.IPNet) (Subnet, error) {
+	k, err := microstorage.NewK(encodeKey(s.pool, network))
+	if err != nil {
+		return Subnet{}, microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return Subnet{}, microerror.Maskf(notFoundError, "subnet %#q", network.String())
+	} else if err != nil {
+		return Subnet{}, microerror.Mask(err)
+	}
+
+	expires, err := s.searchExpiry(ctx, network)
+	if err != nil {
+		return Subnet{}, microerror.Mask(err)
+	}
+
+	r := decodeRecord(kv.Val())
+	subnet := Subnet{
+		Network:    network,
+		Annotation: r.Annotation,
+		Labels:     r.Labels,
+		Expires:    expires,
+	}
+
+	return subnet, nil
+}
+
+// FindByAnnotation returns all stored subnets which were created with the
+// given annotation, ordered by network.
+func (s *Service) FindByAnnotation(ctx context.Context, annotation string) ([]Subnet, error) {
+	existingSubnets, err := s.ListSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var found []Subnet
+	for _, subnet := range existingSubnets {
+		if subnet.Annotation == annotation {
+			found = append(found, subnet)
+		}
+	}
+
+	return found, nil
+}
+
+// FindByLabels returns all stored subnets whose labels match the given
+// selector, ordered by network. See ParseSelector for the syntax of
+// selectors.
+func (s *Service) FindByLabels(ctx context.Context, selector string) ([]Subnet, error) {
+	sel, err := ParseSelector(selector)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	existingSubnets, err := s.ListSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var found []Subnet
+	for _, subnet := range existingSubnets {
+		if sel.Matches(subnet.Labels) {
+			found = append(found, subnet)
+		}
+	}
+
+	return found, nil
+}
+
+// FreeBlocks returns the free space of the networks returned by Networks as
+// the minimal sorted list of networks. Stored, allocated, excluded and the
+// given reserved subnets are not free.
+func (s *Service) FreeBlocks(ctx context.Context, reserved []net.IPNet) ([]net.IPNet, error) {
+	networks, err := s.Networks(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var subnets []net.IPNet
+	subnets = append(subnets, existingSubnets...)
+	subnets = append(subnets, reserved...)
+	subnets = append(subnets, s.allocatedSubnets...)
+	subnets = append(subnets, s.excluded...)
+
+	free := NewCIDRSet(networks).Subtract(NewCIDRSet(subnets))
+
+	return free.CIDRs(), nil
+}
+
+// listSubnets retrieves the stored subnets from storage and returns them.
+func (s *Service) listSubnets(ctx context.Context) ([]net.IPNet, error) {
+	existingSubnets, err := s.ListSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var networks []net.IPNet
+	for _, subnet := range existingSubnets {
+		networks = append(networks, subnet.Network)
+	}
+
+	return networks, nil
+}
+
+// freeSubnet returns an available subnet, of the given size, from the given
+// networks, as chosen by the configured strategy. Existing, reserved,
+// allocated and excluded subnets are not handed out.
+func (s *Service) freeSubnet(networks []net.IPNet, mask net.IPMask, existingSubnets []net.IPNet, reserved []net.IPNet) (net.IPNet, error) {
+	var subnets []net.IPNet
+	subnets = append(subnets, existingSubnets...)
+	subnets = append(subnets, reserved...)
+	subnets = append(subnets, s.allocatedSubnets...)
+
+	// CanonicalizeSubnets filters the given list in place, so each network
+	// gets its own copy.
+	var canonicalized []net.IPNet
+	for _, network := range networks {
+		c := append([]net.IPNet(nil), subnets...)
+		canonicalized = append(canonicalized, CanonicalizeSubnets(network, c)...)
+	}
+	canonicalized = append(canonicalized, s.excludedSubnets(networks)...)
+
+	subnet, err := FreeInNetworks(networks, mask, canonicalized, s.strategy)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	return subnet, nil
+}
+
+// excludedSubnets returns the parts of the excluded ranges overlapping with the
+// given networks, as the minimal sorted list of networks, each of which is
+// contained by one of the given networks.
+func (s *Service) excludedSubnets(networks []net.IPNet) []net.IPNet {
+	if len(s.excluded) == 0 {
+		return nil
+	}
+
+	excluded := NewCIDRSet(s.excluded).Intersect(NewCIDRSet(networks))
+
+	return excluded.CIDRs()
+}
+
+// put stores the given value under the given key.
+func (s *Service) put(ctx context.Context, key, val string) error {
+	kv, err := microstorage.NewKV(key, val)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.storage.Put(ctx, kv); err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// delete removes the given key from storage.
+func (s *Service) delete(ctx context.Context, key string) error {
+	k, err := microstorage.NewK(key)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.storage.Delete(ctx, k); err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// rollback deletes the given keys, logging but otherwise ignoring any
+// errors, as it is only called when an operation has already failed.
+func (s *Service) rollback(ctx context.Context, keys []string) {
+	for _, key := range keys {
+		err := s.delete(ctx, key)
+		if err != nil {
+			s.logger.LogCtx(ctx, "level", "error", "message", fmt.Sprintf("failed to roll back key %#q", key), "stack", fmt.Sprintf("%#v", err))
+		}
+	}
+}
+
+// CreateSubnet returns an available subnet, of the configured size, from the
+// configured network of the address family of the mask, or the networks
+// attached to it, as chosen by the configured strategy. Concurrent calls
+// within this process never return the same subnet. Concurrent calls of other
+// processes sharing the same storage are only serialised with
+// Config.StorageLock, on a best-effort basis.
 func (s *Service) CreateSubnet(ctx context.Context, mask net.IPMask, annotation string, reserved []net.IPNet) (net.IPNet, error) {
+	subnet, err := s.CreateSubnetWithTTL(ctx, mask, annotation, reserved, 0)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	return subnet, nil
+}
+
+// CreateSubnetWithTTL is like CreateSubnet, but the returned subnet expires
+// after the given ttl, unless it is renewed with RenewLease. Expired subnets
+// are freed by Reap. A ttl of zero creates a subnet which does not expire.
+func (s *Service) CreateSubnetWithTTL(ctx context.Context, mask net.IPMask, annotation string, reserved []net.IPNet, ttl time.Duration) (net.IPNet, error) {
 	s.logger.LogCtx(ctx, "level", "debug", "message", "creating subnet")
-	defer updateMetrics("create", time.Now())
+	defer updateMetrics(s.pool, "create", time.Now())
+
+	if ttl < 0 {
+		return net.IPNet{}, microerror.Maskf(invalidParameterError, "ttl %v must not be negative", ttl)
+	}
+
+	subnet, err := s.createSubnet(ctx, mask, annotation, nil, reserved, ttl)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", "created subnet")
+
+	return subnet, nil
+}
+
+// CreateSubnetWithLabels is like CreateSubnet, but the returned subnet is
+// stored with the given labels instead of an annotation. Subnets can be
+// selected by their labels with FindByLabels. Label keys and values follow
+// the syntax of Kubernetes labels, e.g. `giantswarm.io/cluster: a8f3k`.
+func (s *Service) CreateSubnetWithLabels(ctx context.Context, mask net.IPMask, labels map[string]string, reserved []net.IPNet) (net.IPNet, error) {
+	s.logger.LogCtx(ctx, "level", "debug", "message", "creating subnet with labels")
+	defer updateMetrics(s.pool, "create_with_labels", time.Now())
 
-	existingSubnets, err := s.listSubnets(ctx)
+	if err := validateLabels(labels); err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	subnet, err := s.createSubnet(ctx, mask, "", labels, reserved, 0)
 	if err != nil {
 		return net.IPNet{}, microerror.Mask(err)
 	}
 
-	existingSubnets = append(existingSubnets, reserved...)
-	existingSubnets = append(existingSubnets, s.allocatedSubnets...)
-	existingSubnets = CanonicalizeSubnets(s.network, existingSubnets)
+	s.refreshStats(ctx)
 
-	subnet, err := Free(s.network, mask, existingSubnets)
+	s.logger.LogCtx(ctx, "level", "debug", "message", "created subnet with labels")
+
+	return subnet, nil
+}
+
+// createSubnet stores and returns an available subnet, of the given size,
+// with the given annotation and labels, which expires after the given ttl
+// unless it is zero.
+func (s *Service) createSubnet(ctx context.Context, mask net.IPMask, annotation string, labels map[string]string, reserved []net.IPNet, ttl time.Duration) (net.IPNet, error) {
+	val, err := encodeRecord(annotation, labels)
 	if err != nil {
 		return net.IPNet{}, microerror.Mask(err)
 	}
 
-	kv, err := microstorage.NewKV(encodeKey(subnet), annotation)
+	unlock, err := s.lock(ctx)
 	if err != nil {
 		return net.IPNet{}, microerror.Mask(err)
 	}
-	if err := s.storage.Put(ctx, kv); err != nil {
+	defer unlock()
+
+	attached, err := s.listAttachedNetworks(ctx)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
 		return net.IPNet{}, microerror.Mask(err)
 	}
 
-	s.logger.LogCtx(ctx, "level", "debug", "message", "created subnet")
+	subnet, err := s.freeSubnet(s.familyNetworks(mask, attached), mask, existingSubnets, reserved)
+	if err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	if err := s.checkLock(ctx); err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+	if err := s.put(ctx, encodeKey(s.pool, subnet), val); err != nil {
+		return net.IPNet{}, microerror.Mask(err)
+	}
+
+	// The expiry is written after the subnet, so that an expiry is never
+	// stored for a subnet which is free. Should writing the expiry fail, the
+	// subnet is rolled back, rather than being kept forever.
+	if ttl > 0 {
+		err := s.putExpiry(ctx, subnet, s.clock().Add(ttl))
+		if err != nil {
+			s.rollback(ctx, []string{encodeKey(s.pool, subnet)})
+			return net.IPNet{}, microerror.Mask(err)
+		}
+	}
 
 	return subnet, nil
 }
 
+// CreateSubnetWithCIDR stores the given subnet with the given annotation. The
+// subnet must be contained by one of the networks returned by Networks and
+// aligned to its mask. An error matched by IsOverlap, naming the conflicting
+// subnet, is returned when the subnet overlaps with stored, reserved,
+// allocated or excluded subnets.
+func (s *Service) CreateSubnetWithCIDR(ctx context.Context, subnet net.IPNet, annotation string, reserved []net.IPNet) error {
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("creating subnet %#q", subnet.String()))
+	defer updateMetrics(s.pool, "create_with_cidr", time.Now())
+
+	if !subnet.IP.Equal(subnet.IP.Mask(subnet.Mask)) {
+		return microerror.Maskf(invalidParameterError, "subnet %#q is not aligned to its mask", subnet.String())
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	defer unlock()
+
+	networks, err := s.Networks(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	var contained bool
+	for _, network := range networks {
+		if Contains(network, subnet) {
+			contained = true
+			break
+		}
+	}
+	if !contained {
+		return microerror.Maskf(ipNotContainedError, "%v is not contained by any network of pool %#q", subnet.String(), s.pool)
+	}
+
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	var subnets []net.IPNet
+	subnets = append(subnets, existingSubnets...)
+	subnets = append(subnets, reserved...)
+	subnets = append(subnets, s.allocatedSubnets...)
+	subnets = append(subnets, s.excluded...)
+	for _, n := range subnets {
+		if overlaps(subnet, n) {
+			return microerror.Maskf(overlapError, "subnet %#q overlaps with subnet %#q", subnet.String(), n.String())
+		}
+	}
+
+	val, err := encodeRecord(annotation, nil)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.checkLock(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.put(ctx, encodeKey(s.pool, subnet), val); err != nil {
+		return microerror.Mask(err)
+	}
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("created subnet %#q", subnet.String()))
+
+	return nil
+}
+
+// CreateDualStackSubnet returns the next available IPv4 and IPv6 subnets, of
+// the given sizes, from the configured networks. Both subnets are stored with
+// the same annotation. When either of the networks is exhausted no subnet is
+// stored. Deleting one subnet of the pair with DeleteSubnet releases both.
+func (s *Service) CreateDualStackSubnet(ctx context.Context, ipv4Mask, ipv6Mask net.IPMask, annotation string, reserved []net.IPNet) (net.IPNet, net.IPNet, error) {
+	s.logger.LogCtx(ctx, "level", "debug", "message", "creating dual-stack subnet")
+	defer updateMetrics(s.pool, "create_dual_stack", time.Now())
+
+	if s.ipv6Network == nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Maskf(invalidConfigError, "ipv6 network must be configured for dual-stack subnets")
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+	}
+	defer unlock()
+
+	attached, err := s.listAttachedNetworks(ctx)
+	if err != nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+	}
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+	}
+
+	ipv4Subnet, err := s.freeSubnet(s.expandNetwork(s.network, attached), ipv4Mask, existingSubnets, reserved)
+	if err != nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+	}
+	ipv6Subnet, err := s.freeSubnet(s.expandNetwork(*s.ipv6Network, attached), ipv6Mask, existingSubnets, reserved)
+	if err != nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+	}
+
+	val, err := encodeRecord(annotation, nil)
+	if err != nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+	}
+	if err := s.checkLock(ctx); err != nil {
+		return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+	}
+
+	// The subnets are written before the keys linking them, so that a pair
+	// link never refers to a subnet that is not stored. Whatever has been
+	// written is rolled back on failure, so that the pair is never stored
+	// partially.
+	kvs := []struct {
+		key string
+		val string
+	}{
+		{key: encodeKey(s.pool, ipv4Subnet), val: val},
+		{key: encodeKey(s.pool, ipv6Subnet), val: val},
+		{key: encodePairKey(s.pool, ipv4Subnet), val: ipv6Subnet.String()},
+		{key: encodePairKey(s.pool, ipv6Subnet), val: ipv4Subnet.String()},
+	}
+	var written []string
+	for _, kv := range kvs {
+		err := s.put(ctx, kv.key, kv.val)
+		if err != nil {
+			s.rollback(ctx, written)
+			return net.IPNet{}, net.IPNet{}, microerror.Mask(err)
+		}
+		written = append(written, kv.key)
+	}
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", "created dual-stack subnet")
+
+	return ipv4Subnet, ipv6Subnet, nil
+}
+
 // DeleteSubnet deletes the given subnet from IPAM storage,
-// meaning it can be given out again.
+// meaning it can be given out again. When the subnet was created by
+// CreateDualStackSubnet, its partner subnet is deleted as well. Addresses
+// allocated from the subnet by a HostAllocator are released. An error
+// matched by IsInUse is returned when the subnet is delegated to a child pool
+// which still holds subnets, see Delegate.
 func (s *Service) DeleteSubnet(ctx context.Context, subnet net.IPNet) error {
 	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("deleting subnet %#q", subnet.String()))
-	defer updateMetrics("delete", time.Now())
+	defer updateMetrics(s.pool, "delete", time.Now())
 
-	k, err := microstorage.NewK(encodeKey(subnet))
+	unlock, err := s.lock(ctx)
 	if err != nil {
 		return microerror.Mask(err)
 	}
-	if err := s.storage.Delete(ctx, k); err != nil {
+	defer unlock()
+
+	err = s.deleteSubnet(ctx, subnet)
+	if err != nil {
 		return microerror.Mask(err)
 	}
 
+	s.refreshStats(ctx)
+
 	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("deleted subnet %#q", subnet.String()))
 
 	return nil
 }
+
+// deleteSubnet deletes the given subnet, see DeleteSubnet. It must only be
+// called while holding the lock.
+func (s *Service) deleteSubnet(ctx context.Context, subnet net.IPNet) error {
+	subnets := []net.IPNet{subnet}
+	{
+		partner, err := s.searchPartner(ctx, subnet)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+		if partner != nil {
+			subnets = append(subnets, *partner)
+		}
+	}
+
+	// Delegated subnets are only deleted once their child pools are empty.
+	if err := s.undelegate(ctx, subnets); err != nil {
+		return microerror.Mask(err)
+	}
+
+	if err := s.checkLock(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+
+	// The owner index entries are deleted first, as they claim the subnets
+	// on their own, see listClaimedSubnets.
+	if err := s.deleteOwners(ctx, subnets); err != nil {
+		return microerror.Mask(err)
+	}
+
+	// The allocated addresses are deleted before the subnets, so that they
+	// are not taken anymore once the subnets are allocated again.
+	if err := s.deleteHosts(ctx, subnets); err != nil {
+		return microerror.Mask(err)
+	}
+
+	// The expiries are deleted before the subnets, so that a failure part
+	// way through never leaves an expiry behind which would free the subnet
+	// once it is allocated again.
+	for _, n := range subnets {
+		if err := s.delete(ctx, encodeExpiryKey(s.pool, n)); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+
+	// The pair keys are deleted before the subnets, so that a failure part
+	// way through never leaves a pair link behind which refers to a deleted
+	// subnet.
+	if len(subnets) > 1 {
+		for _, n := range subnets {
+			if err := s.delete(ctx, encodePairKey(s.pool, n)); err != nil {
+				return microerror.Mask(err)
+			}
+		}
+	}
+
+	for _, n := range subnets {
+		if err := s.delete(ctx, encodeKey(s.pool, n)); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+
+	return nil
+}
+
+// searchPartner returns the subnet that was created together with the given
+// subnet by CreateDualStackSubnet, or nil if there is none.
+func (s *Service) searchPartner(ctx context.Context, subnet net.IPNet) (*net.IPNet, error) {
+	k, err := microstorage.NewK(encodePairKey(s.pool, subnet))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	_, partner, err := net.ParseCIDR(kv.Val())
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return partner, nil
+}
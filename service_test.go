@@ -5,9 +5,13 @@ import (
 	"context"
 	"fmt"
 	"net"
+	"reflect"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage"
 	"github.com/giantswarm/microstorage/memory"
 )
 
@@ -20,6 +24,7 @@ func TestNew(t *testing.T) {
 	}
 
 	_, testNetwork, _ := net.ParseCIDR("10.4.0.0/16")
+	_, testIPv6Network, _ := net.ParseCIDR("fd00::/48")
 
 	tests := []struct {
 		config               func() Config
@@ -80,6 +85,56 @@ func TestNew(t *testing.T) {
 			},
 			expectedErrorHandler: IsInvalidConfig,
 		},
+
+		// Test that a dual-stack config returns a new IPAM service.
+		{
+			config: func() Config {
+				c := Config{
+					Logger:      testLogger,
+					Storage:     testStorage,
+					Network:     testNetwork,
+					IPv6Network: testIPv6Network,
+					AllocatedSubnets: []net.IPNet{
+						mustParseCIDR("10.4.0.0/24"),
+						mustParseCIDR("fd00::/64"),
+					},
+				}
+
+				return c
+			},
+		},
+
+		// Test that a dual-stack config with two IPv6 networks returns an
+		// invalid config error.
+		{
+			config: func() Config {
+				c := Config{
+					Logger:      testLogger,
+					Storage:     testStorage,
+					Network:     testIPv6Network,
+					IPv6Network: testIPv6Network,
+				}
+
+				return c
+			},
+			expectedErrorHandler: IsInvalidConfig,
+		},
+
+		// Test that a dual-stack config with two IPv4 networks returns an
+		// invalid config error.
+		{
+			config: func() Config {
+				c := Config{
+					Logger:      testLogger,
+					Storage:     testStorage,
+					Network:     testNetwork,
+					IPv6Network: testNetwork,
+				}
+
+				return c
+			},
+			expectedErrorHandler: IsInvalidConfig,
+		},
 	}
 
 	for index, test := range tests {
@@ -242,6 +297,33 @@ func TestNewSubnetAndDeleteSubnet(t *testing.T) {
 				},
 			},
 		},
+
+		// Test that adding and deleting subnets in an IPv6 network works
+		// correctly.
+		{
+			network: "fd00::/48",
+			steps: []step{
+				{
+					add:            true,
+					mask:           64,
+					expectedSubnet: "fd00::/64",
+				},
+				{
+					add:            true,
+					mask:           56,
+					expectedSubnet: "fd00:0:0:100::/56",
+				},
+				{
+					add:            false,
+					subnetToDelete: "fd00::/64",
+				},
+				{
+					add:            true,
+					mask:           60,
+					expectedSubnet: "fd00::/60",
+				},
+			},
+		},
 	}
 
 	for index, test := range tests {
@@ -269,9 +351,11 @@ func TestNewSubnetAndDeleteSubnet(t *testing.T) {
 			t.Fatalf("%v: error returned creating ipam service: %v", index, err)
 		}
 
+		_, bits := network.Mask.Size()
+
 		for _, step := range test.steps {
 			if step.add {
-				mask := net.CIDRMask(step.mask, 32)
+				mask := net.CIDRMask(step.mask, bits)
 
 				returnedSubnet, err := service.CreateSubnet(context.Background(), mask, fmt.Sprintf("test-%d", index), nil)
 				if err != nil {
@@ -466,3 +550,710 @@ func TestNewWithAllocatedNetworks(t *testing.T) {
 		}
 	}
 }
+
+// TestCreateDualStackSubnet tests that CreateDualStackSubnet allocates pairs
+// of subnets atomically, and that DeleteSubnet releases both of them.
+func TestCreateDualStackSubnet(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	ipv4Network := mustParseCIDR("10.4.0.0/23")
+	ipv6Network := mustParseCIDR("fd00::/63")
+
+	service, err := New(Config{
+		Logger:      microloggertest.New(),
+		Storage:     storage,
+		Network:     &ipv4Network,
+		IPv6Network: &ipv6Network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	ipv4Mask := net.CIDRMask(24, 32)
+	ipv6Mask := net.CIDRMask(64, 128)
+
+	first4, first6, err := service.CreateDualStackSubnet(ctx, ipv4Mask, ipv6Mask, "first", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating dual-stack subnet: %v", err)
+	}
+	if !ipNetEqual(first4, mustParseCIDR("10.4.0.0/24")) || !ipNetEqual(first6, mustParseCIDR("fd00::/64")) {
+		t.Fatalf("unexpected subnets returned: %v, %v", first4.String(), first6.String())
+	}
+
+	// A single stack subnet only takes IPv4 space, so that the next pair
+	// does not fit anymore.
+	single, err := service.CreateSubnet(ctx, ipv4Mask, "single", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(single, mustParseCIDR("10.4.1.0/24")) {
+		t.Fatalf("unexpected subnet returned: %v", single.String())
+	}
+
+	_, _, err = service.CreateDualStackSubnet(ctx, ipv4Mask, ipv6Mask, "second", nil)
+	if !IsSpaceExhausted(err) {
+		t.Fatalf("expected space exhausted error, got: %v", err)
+	}
+
+	// Nothing of the failed pair must have been stored.
+	subnets, err := service.listSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 3 {
+		t.Fatalf("expected 3 stored subnets, got %v", subnets)
+	}
+
+	// Deleting the IPv6 half of the pair releases the IPv4 half as well.
+	if err := service.DeleteSubnet(ctx, first6); err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+
+	subnets, err = service.listSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 1 || !ipNetEqual(subnets[0], single) {
+		t.Fatalf("expected only %v to be stored, got %v", single.String(), subnets)
+	}
+
+	second4, second6, err := service.CreateDualStackSubnet(ctx, ipv4Mask, ipv6Mask, "second", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating dual-stack subnet: %v", err)
+	}
+	if !ipNetEqual(second4, first4) || !ipNetEqual(second6, first6) {
+		t.Fatalf("unexpected subnets returned: %v, %v", second4.String(), second6.String())
+	}
+
+	// Deleting a single stack subnet leaves the pair alone.
+	if err := service.DeleteSubnet(ctx, single); err != nil {
+		t.Fatalf("unexpected error returned deleting subnet: %v", err)
+	}
+
+	subnets, err = service.listSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 2 {
+		t.Fatalf("expected 2 stored subnets, got %v", subnets)
+	}
+
+	// Single stack subnets of IPv6 masks are allocated from the IPv6
+	// network.
+	single6, err := service.CreateSubnet(ctx, ipv6Mask, "single", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(single6, mustParseCIDR("fd00:0:0:1::/64")) {
+		t.Fatalf("unexpected subnet returned: %v", single6.String())
+	}
+}
+
+// TestCreateDualStackSubnetSingleStack tests that CreateDualStackSubnet
+// returns an error when no IPv6 network is configured.
+func TestCreateDualStackSubnetSingleStack(t *testing.T) {
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	_, _, err = service.CreateDualStackSubnet(context.Background(), net.CIDRMask(24, 32), net.CIDRMask(64, 128), "", nil)
+	if !IsInvalidConfig(err) {
+		t.Fatalf("expected invalid config error, got: %v", err)
+	}
+}
+
+// TestListGetAndFindSubnets tests that ListSubnets, GetSubnet and
+// FindByAnnotation return the stored subnets along with their annotations.
+func TestListGetAndFindSubnets(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	subnets, err := service.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 0 {
+		t.Fatalf("expected no subnets, got %v", subnets)
+	}
+
+	for _, annotation := range []string{"cluster-a", "cluster-b", "cluster-a"} {
+		_, err := service.CreateSubnet(ctx, net.CIDRMask(24, 32), annotation, nil)
+		if err != nil {
+			t.Fatalf("unexpected error returned creating subnet: %v", err)
+		}
+	}
+
+	expectedSubnets := []Subnet{
+		{Network: mustParseCIDR("10.4.0.0/24"), Annotation: "cluster-a"},
+		{Network: mustParseCIDR("10.4.1.0/24"), Annotation: "cluster-b"},
+		{Network: mustParseCIDR("10.4.2.0/24"), Annotation: "cluster-a"},
+	}
+
+	subnets, err = service.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if !subnetsEqual(subnets, expectedSubnets) {
+		t.Fatalf("unexpected subnets returned.\nexpected: %v\nreturned: %v", expectedSubnets, subnets)
+	}
+
+	subnet, err := service.GetSubnet(ctx, mustParseCIDR("10.4.1.0/24"))
+	if err != nil {
+		t.Fatalf("unexpected error returned getting subnet: %v", err)
+	}
+	if !subnetsEqual([]Subnet{subnet}, expectedSubnets[1:2]) {
+		t.Fatalf("unexpected subnet returned.\nexpected: %v\nreturned: %v", expectedSubnets[1], subnet)
+	}
+
+	_, err = service.GetSubnet(ctx, mustParseCIDR("10.4.3.0/24"))
+	if !IsNotFound(err) {
+		t.Fatalf("expected not found error, got: %v", err)
+	}
+
+	subnets, err = service.FindByAnnotation(ctx, "cluster-a")
+	if err != nil {
+		t.Fatalf("unexpected error returned finding subnets: %v", err)
+	}
+	if !subnetsEqual(subnets, []Subnet{expectedSubnets[0], expectedSubnets[2]}) {
+		t.Fatalf("unexpected subnets returned: %v", subnets)
+	}
+
+	subnets, err = service.FindByAnnotation(ctx, "cluster-c")
+	if err != nil {
+		t.Fatalf("unexpected error returned finding subnets: %v", err)
+	}
+	if len(subnets) != 0 {
+		t.Fatalf("expected no subnets, got %v", subnets)
+	}
+}
+
+// subnetsEqual returns true if both given lists of Subnets are equal, false
+// otherwise.
+func subnetsEqual(a, b []Subnet) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := 0; i < len(a); i++ {
+		if !ipNetEqual(a[i].Network, b[i].Network) || a[i].Annotation != b[i].Annotation {
+			return false
+		}
+	}
+
+	return true
+}
+
+// TestCreateSubnetConcurrent tests that concurrent calls to CreateSubnet,
+// within one service and across services sharing one storage, never return
+// the same subnet twice.
+func TestCreateSubnetConcurrent(t *testing.T) {
+	tests := []struct {
+		name        string
+		services    int
+		goroutines  int
+		allocations int
+		storageLock bool
+	}{
+		{
+			name:        "case 0: one service",
+			services:    1,
+			goroutines:  32,
+			allocations: 4,
+		},
+		{
+			name:        "case 1: several services sharing one storage",
+			services:    4,
+			goroutines:  8,
+			allocations: 4,
+		},
+		{
+			name:        "case 2: several processes sharing one storage with the storage lock",
+			services:    4,
+			goroutines:  2,
+			allocations: 2,
+			storageLock: true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			storage, err := memory.New(memory.Config{})
+			if err != nil {
+				t.Fatalf("error creating new storage: %v", err)
+			}
+
+			network := mustParseCIDR("10.4.0.0/16")
+
+			var services []*Service
+			for i := 0; i < tc.services; i++ {
+				service, err := New(Config{
+					Logger:  microloggertest.New(),
+					Storage: storage,
+					Network: &network,
+
+					StorageLock: tc.storageLock,
+				})
+				if err != nil {
+					t.Fatalf("error returned creating ipam service: %v", err)
+				}
+				// Each service stands in for a process of its own, which
+				// does not share the mutex of the pool.
+				if tc.storageLock {
+					service.mutex = &sync.Mutex{}
+				}
+				services = append(services, service)
+			}
+
+			var wg sync.WaitGroup
+			results := make(chan net.IPNet, tc.services*tc.goroutines*tc.allocations)
+			errors := make(chan error, tc.services*tc.goroutines*tc.allocations)
+			for _, service := range services {
+				for i := 0; i < tc.goroutines; i++ {
+					wg.Add(1)
+					go func(service *Service) {
+						defer wg.Done()
+
+						for j := 0; j < tc.allocations; j++ {
+							subnet, err := service.CreateSubnet(context.Background(), net.CIDRMask(24, 32), "", nil)
+							if err != nil {
+								errors <- err
+								return
+							}
+							results <- subnet
+						}
+					}(service)
+				}
+			}
+			wg.Wait()
+			close(results)
+			close(errors)
+
+			for err := range errors {
+				t.Fatalf("unexpected error returned creating subnet: %v", err)
+			}
+
+			seen := map[string]bool{}
+			for subnet := range results {
+				if seen[subnet.String()] {
+					t.Fatalf("subnet %v returned more than once", subnet.String())
+				}
+				seen[subnet.String()] = true
+			}
+
+			if len(seen) != tc.services*tc.goroutines*tc.allocations {
+				t.Fatalf("expected %d subnets, got %d", tc.services*tc.goroutines*tc.allocations, len(seen))
+			}
+
+			subnets, err := services[0].ListSubnets(context.Background())
+			if err != nil {
+				t.Fatalf("unexpected error returned listing subnets: %v", err)
+			}
+			if len(subnets) != len(seen) {
+				t.Fatalf("expected %d stored subnets, got %d", len(seen), len(subnets))
+			}
+		})
+	}
+}
+
+// TestLockExpiry tests that the storage lock expires according to the
+// configured clock, and is then taken over by other services.
+func TestLockExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	var mutex sync.Mutex
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return now
+	}
+
+	var services []*Service
+	for i := 0; i < 2; i++ {
+		service, err := New(Config{
+			Logger:  microloggertest.New(),
+			Storage: storage,
+			Network: &network,
+			Clock:   clock,
+
+			StorageLock: true,
+		})
+		if err != nil {
+			t.Fatalf("error returned creating ipam service: %v", err)
+		}
+		// Each service stands in for a process of its own, which does not
+		// share the mutex of the pool.
+		service.mutex = &sync.Mutex{}
+		services = append(services, service)
+	}
+
+	unlockA, err := services[0].lock(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error acquiring lock: %v", err)
+	}
+
+	// The lock is held, so acquiring it blocks until the context is done.
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	_, err = services[1].lock(timeoutCtx)
+	cancel()
+	if err == nil {
+		t.Fatalf("expected error acquiring held lock")
+	}
+
+	mutex.Lock()
+	now = now.Add(lockTTL)
+	mutex.Unlock()
+
+	if err := services[0].checkLock(ctx); !IsLockLost(err) {
+		t.Fatalf("expected lock lost error, got %v", err)
+	}
+
+	unlockB, err := services[1].lock(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error taking over lock: %v", err)
+	}
+	defer unlockB()
+
+	// Releasing the expired lock keeps the lock of the new owner.
+	unlockA()
+	if err := services[1].checkLock(ctx); err != nil {
+		t.Fatalf("unexpected error checking lock: %v", err)
+	}
+}
+
+// TestCreateSubnetWithCIDR tests the CreateSubnetWithCIDR method.
+func TestCreateSubnetWithCIDR(t *testing.T) {
+	tests := []struct {
+		name                 string
+		stored               []string
+		allocatedSubnets     []string
+		reserved             []string
+		subnet               net.IPNet
+		expectedErrorHandler func(error) bool
+	}{
+		{
+			name:   "case 0: claim a free subnet",
+			stored: []string{"10.4.0.0/24"},
+			subnet: mustParseCIDR("10.4.7.0/24"),
+		},
+		{
+			name:                 "case 1: claim a stored subnet",
+			stored:               []string{"10.4.7.0/24"},
+			subnet:               mustParseCIDR("10.4.7.0/24"),
+			expectedErrorHandler: IsOverlap,
+		},
+		{
+			name:                 "case 2: claim a subnet containing a stored subnet",
+			stored:               []string{"10.4.7.128/25"},
+			subnet:               mustParseCIDR("10.4.7.0/24"),
+			expectedErrorHandler: IsOverlap,
+		},
+		{
+			name:                 "case 3: claim a subnet contained by a reserved subnet",
+			reserved:             []string{"10.4.0.0/20"},
+			subnet:               mustParseCIDR("10.4.7.0/24"),
+			expectedErrorHandler: IsOverlap,
+		},
+		{
+			name:                 "case 4: claim a subnet overlapping an allocated subnet",
+			allocatedSubnets:     []string{"10.4.7.0/26"},
+			subnet:               mustParseCIDR("10.4.7.0/24"),
+			expectedErrorHandler: IsOverlap,
+		},
+		{
+			name:                 "case 5: claim a subnet outside of the network",
+			subnet:               mustParseCIDR("10.5.7.0/24"),
+			expectedErrorHandler: IsIPNotContained,
+		},
+		{
+			name:                 "case 6: claim a subnet larger than the network",
+			subnet:               mustParseCIDR("10.4.0.0/15"),
+			expectedErrorHandler: IsIPNotContained,
+		},
+		{
+			name:                 "case 7: claim a subnet not aligned to its mask",
+			subnet:               net.IPNet{IP: net.ParseIP("10.4.7.5").To4(), Mask: net.CIDRMask(24, 32)},
+			expectedErrorHandler: IsInvalidParameter,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ctx := context.Background()
+
+			storage, err := memory.New(memory.Config{})
+			if err != nil {
+				t.Fatalf("error creating new storage: %v", err)
+			}
+
+			network := mustParseCIDR("10.4.0.0/16")
+
+			var allocatedSubnets []net.IPNet
+			for _, n := range tc.allocatedSubnets {
+				allocatedSubnets = append(allocatedSubnets, mustParseCIDR(n))
+			}
+
+			service, err := New(Config{
+				Logger:           microloggertest.New(),
+				Storage:          storage,
+				Network:          &network,
+				AllocatedSubnets: allocatedSubnets,
+			})
+			if err != nil {
+				t.Fatalf("error returned creating ipam service: %v", err)
+			}
+
+			for _, n := range tc.stored {
+				err := service.CreateSubnetWithCIDR(ctx, mustParseCIDR(n), "stored", nil)
+				if err != nil {
+					t.Fatalf("unexpected error returned storing subnet: %v", err)
+				}
+			}
+
+			var reserved []net.IPNet
+			for _, n := range tc.reserved {
+				reserved = append(reserved, mustParseCIDR(n))
+			}
+
+			err = service.CreateSubnetWithCIDR(ctx, tc.subnet, "claimed", reserved)
+
+			switch {
+			case err == nil && tc.expectedErrorHandler == nil:
+				// correct; carry on
+			case err != nil && tc.expectedErrorHandler == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.expectedErrorHandler != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.expectedErrorHandler(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			subnet, err := service.GetSubnet(ctx, tc.subnet)
+			if tc.expectedErrorHandler == nil {
+				if err != nil {
+					t.Fatalf("unexpected error returned getting subnet: %v", err)
+				}
+				if subnet.Annotation != "claimed" {
+					t.Fatalf("expected annotation %#q, got %#q", "claimed", subnet.Annotation)
+				}
+			} else if err == nil && subnet.Annotation == "claimed" {
+				t.Fatalf("expected subnet %v not to be claimed", tc.subnet.String())
+			}
+		})
+	}
+}
+
+// TestServiceFreeBlocks tests that Service.FreeBlocks excludes stored,
+// allocated and reserved subnets, and includes attached networks.
+func TestServiceFreeBlocks(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/22")
+
+	service, err := New(Config{
+		Logger:           microloggertest.New(),
+		Storage:          storage,
+		Network:          &network,
+		AllocatedSubnets: []net.IPNet{mustParseCIDR("10.4.3.0/24")},
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	err = service.AddNetwork(ctx, mustParseCIDR("10.8.0.0/24"))
+	if err != nil {
+		t.Fatalf("unexpected error returned adding network: %v", err)
+	}
+	_, err = service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	_, err = service.CreateSubnetForOwner(ctx, "cluster-a", net.CIDRMask(25, 32), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	blocks, err := service.FreeBlocks(ctx, []net.IPNet{mustParseCIDR("10.8.0.0/25")})
+	if err != nil {
+		t.Fatalf("unexpected error returned listing free blocks: %v", err)
+	}
+
+	expectedBlocks := []string{"10.4.1.128/25", "10.4.2.0/24", "10.8.0.128/25"}
+	if !reflect.DeepEqual(cidrStrings(blocks), expectedBlocks) {
+		t.Fatalf("expected %v, got %v", expectedBlocks, cidrStrings(blocks))
+	}
+}
+
+// TestExcluded tests that excluded ranges are never allocated, also when they
+// are not contained by the networks of the pool.
+func TestExcluded(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/22")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+		Excluded: []net.IPNet{
+			mustParseCIDR("10.4.0.0/24"),
+			mustParseCIDR("172.17.0.0/16"),
+			mustParseCIDR("192.168.0.0/16"),
+		},
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	// The attached network is excluded entirely, as it is contained by an
+	// excluded range.
+	err = service.AddNetwork(ctx, mustParseCIDR("172.17.5.0/24"))
+	if err != nil {
+		t.Fatalf("unexpected error returned adding network: %v", err)
+	}
+
+	blocks, err := service.FreeBlocks(ctx, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing free blocks: %v", err)
+	}
+	expectedBlocks := []string{"10.4.1.0/24", "10.4.2.0/23"}
+	if !reflect.DeepEqual(cidrStrings(blocks), expectedBlocks) {
+		t.Fatalf("expected %v, got %v", expectedBlocks, cidrStrings(blocks))
+	}
+
+	results, err := service.Forecast(ctx, []net.IPMask{net.CIDRMask(23, 32), net.CIDRMask(23, 32)}, nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned forecasting: %v", err)
+	}
+	if !results[0].Fits || results[0].Subnet.String() != "10.4.2.0/23" || results[1].Fits {
+		t.Fatalf("unexpected forecast %v", results)
+	}
+
+	for _, expected := range []string{"10.4.1.0/24", "10.4.2.0/24", "10.4.3.0/24"} {
+		subnet, err := service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+		if err != nil {
+			t.Fatalf("unexpected error returned creating subnet: %v", err)
+		}
+		if subnet.String() != expected {
+			t.Fatalf("expected subnet %v, got %v", expected, subnet.String())
+		}
+	}
+
+	_, err = service.CreateSubnet(ctx, net.CIDRMask(25, 32), "", nil)
+	if !IsSpaceExhausted(err) {
+		t.Fatalf("expected space exhausted error, got %v", err)
+	}
+	err = service.CreateSubnetWithCIDR(ctx, mustParseCIDR("172.17.5.0/25"), "", nil)
+	if !IsOverlap(err) {
+		t.Fatalf("expected overlap error, got %v", err)
+	}
+
+	stats, err := service.Stats(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting stats: %v", err)
+	}
+	if stats[0].Allocated.Int64() != 1024 || stats[1].Allocated.Int64() != 256 {
+		t.Fatalf("expected all addresses to be allocated, got %v and %v", stats[0].Allocated, stats[1].Allocated)
+	}
+}
+
+// TestLockReleaseCancelled tests that the storage lock is released even when
+// the context of the caller is done.
+func TestLockReleaseCancelled(t *testing.T) {
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: contextStorage{Storage: storage},
+		Network: &network,
+
+		StorageLock: true,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	unlock, err := service.lock(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error acquiring lock: %v", err)
+	}
+	cancel()
+	unlock()
+
+	l, err := service.searchLease(context.Background())
+	if err != nil {
+		t.Fatalf("unexpected error searching lock: %v", err)
+	}
+	if l != nil {
+		t.Fatalf("expected lock to be released, got %v", l)
+	}
+}
+
+// contextStorage is a storage which, like real storage backends, fails to
+// delete keys once the context is done.
+type contextStorage struct {
+	microstorage.Storage
+}
+
+func (s contextStorage) Delete(ctx context.Context, key microstorage.K) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	return s.Storage.Delete(ctx, key)
+}
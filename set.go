@@ -0,0 +1,194 @@
+package ipam
+
+import (
+	"math/big"
+	"net"
+	"sort"
+)
+
+// CIDRSet is an immutable set of IP addresses, built from a list of networks.
+// IPv4 and IPv6 addresses may be mixed. The zero value is the empty set.
+type CIDRSet struct {
+	// ranges are sorted, and neither overlap nor touch each other.
+	ranges []ipRange
+}
+
+// NewCIDRSet returns the set of all addresses within the given networks.
+// The networks may overlap, and their IPs need not be aligned to their masks.
+func NewCIDRSet(networks []net.IPNet) CIDRSet {
+	var ranges []ipRange
+	for _, network := range networks {
+		network.IP = network.IP.Mask(network.Mask)
+		if network.IP == nil {
+			continue
+		}
+		ranges = append(ranges, newIPRange(network))
+	}
+
+	return CIDRSet{ranges: mergeIPRanges(ranges)}
+}
+
+// CIDRs returns the minimal sorted list of networks covering exactly the
+// addresses of the set, IPv4 networks first.
+func (s CIDRSet) CIDRs() []net.IPNet {
+	networks := []net.IPNet{}
+	for _, r := range s.ranges {
+		networks = append(networks, rangeToCIDRs(r)...)
+	}
+
+	return networks
+}
+
+// Contains returns true when all addresses of the given network are within
+// the set, false otherwise.
+func (s CIDRSet) Contains(network net.IPNet) bool {
+	return NewCIDRSet([]net.IPNet{network}).Subtract(s).IsEmpty()
+}
+
+// Equal returns true when both sets contain the same addresses, false
+// otherwise.
+func (s CIDRSet) Equal(o CIDRSet) bool {
+	if len(s.ranges) != len(o.ranges) {
+		return false
+	}
+	for i := range s.ranges {
+		if !s.ranges[i].start.Equal(o.ranges[i].start) || !s.ranges[i].end.Equal(o.ranges[i].end) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// Intersect returns the set of addresses within both sets.
+func (s CIDRSet) Intersect(o CIDRSet) CIDRSet {
+	var ranges []ipRange
+	for _, a := range s.ranges {
+		for _, b := range o.ranges {
+			if !rangesOverlap(a, b) {
+				continue
+			}
+
+			r := a
+			if compareIP(b.start, r.start) > 0 {
+				r.start = b.start
+			}
+			if compareIP(b.end, r.end) < 0 {
+				r.end = b.end
+			}
+			ranges = append(ranges, r)
+		}
+	}
+
+	return CIDRSet{ranges: mergeIPRanges(ranges)}
+}
+
+// IsEmpty returns true when the set contains no addresses, false otherwise.
+func (s CIDRSet) IsEmpty() bool {
+	return len(s.ranges) == 0
+}
+
+// Overlaps returns true when both sets share at least one address, false
+// otherwise.
+func (s CIDRSet) Overlaps(o CIDRSet) bool {
+	for _, a := range s.ranges {
+		for _, b := range o.ranges {
+			if rangesOverlap(a, b) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// Subtract returns the set of addresses within this set, excluding those
+// within the given set.
+func (s CIDRSet) Subtract(o CIDRSet) CIDRSet {
+	var ranges []ipRange
+	for _, a := range s.ranges {
+		start := ipToDecimal(a.start)
+		end := ipToDecimal(a.end)
+		length := ipLength(a.start)
+
+		// The ranges of the other set are sorted, so the remainder of the
+		// range is cut from left to right.
+		for _, b := range o.ranges {
+			if !rangesOverlap(a, b) {
+				continue
+			}
+
+			bStart := ipToDecimal(b.start)
+			bEnd := ipToDecimal(b.end)
+			if bStart.Cmp(start) > 0 {
+				ranges = append(ranges, ipRange{
+					start: decimalToIP(start, length),
+					end:   decimalToIP(new(big.Int).Sub(bStart, big.NewInt(1)), length),
+				})
+			}
+			start = bEnd.Add(bEnd, big.NewInt(1))
+		}
+
+		if start.Cmp(end) <= 0 {
+			ranges = append(ranges, ipRange{
+				start: decimalToIP(start, length),
+				end:   decimalToIP(end, length),
+			})
+		}
+	}
+
+	return CIDRSet{ranges: ranges}
+}
+
+// Union returns the set of addresses within either set.
+func (s CIDRSet) Union(o CIDRSet) CIDRSet {
+	var ranges []ipRange
+	ranges = append(ranges, s.ranges...)
+	ranges = append(ranges, o.ranges...)
+
+	return CIDRSet{ranges: mergeIPRanges(ranges)}
+}
+
+// addressCount returns the number of addresses within the set.
+func (s CIDRSet) addressCount() *big.Int {
+	count := big.NewInt(0)
+	for _, r := range s.ranges {
+		count.Add(count, ipToDecimal(r.end))
+		count.Sub(count, ipToDecimal(r.start))
+		count.Add(count, big.NewInt(1))
+	}
+
+	return count
+}
+
+// mergeIPRanges sorts the given ranges, and merges those which overlap or
+// touch each other.
+func mergeIPRanges(ranges []ipRange) []ipRange {
+	sorted := append([]ipRange(nil), ranges...)
+	sort.Sort(ipRanges(sorted))
+
+	var merged []ipRange
+	for _, r := range sorted {
+		if len(merged) > 0 {
+			last := &merged[len(merged)-1]
+
+			next := ipToDecimal(last.end)
+			next.Add(next, big.NewInt(1))
+			if ipLength(last.start) == ipLength(r.start) && ipToDecimal(r.start).Cmp(next) <= 0 {
+				if compareIP(r.end, last.end) > 0 {
+					last.end = r.end
+				}
+				continue
+			}
+		}
+		merged = append(merged, r)
+	}
+
+	return merged
+}
+
+// rangesOverlap returns true when the given ranges share at least one
+// address, false otherwise.
+func rangesOverlap(a, b ipRange) bool {
+	return compareIP(a.start, b.end) <= 0 && compareIP(b.start, a.end) <= 0
+}
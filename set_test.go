@@ -0,0 +1,184 @@
+package ipam
+
+import (
+	"net"
+	"testing"
+)
+
+// mustParseCIDRs parses the given list of CIDRs, and panics on error.
+func mustParseCIDRs(cidrs []string) []net.IPNet {
+	var networks []net.IPNet
+	for _, cidr := range cidrs {
+		networks = append(networks, mustParseCIDR(cidr))
+	}
+
+	return networks
+}
+
+// cidrStrings returns the CIDR notation of the given networks.
+func cidrStrings(networks []net.IPNet) []string {
+	strings := []string{}
+	for _, network := range networks {
+		strings = append(strings, network.String())
+	}
+
+	return strings
+}
+
+// TestCIDRSet tests the set operations of CIDRSet.
+func TestCIDRSet(t *testing.T) {
+	tests := []struct {
+		name              string
+		a                 []string
+		b                 []string
+		expectedUnion     []string
+		expectedIntersect []string
+		expectedSubtract  []string
+		expectedOverlaps  bool
+		expectedEqual     bool
+	}{
+		{
+			name:              "case 0: empty sets",
+			expectedUnion:     []string{},
+			expectedIntersect: []string{},
+			expectedSubtract:  []string{},
+			expectedEqual:     true,
+		},
+		{
+			name:              "case 1: adjacent siblings are merged",
+			a:                 []string{"10.4.0.0/24"},
+			b:                 []string{"10.4.1.0/24"},
+			expectedUnion:     []string{"10.4.0.0/23"},
+			expectedIntersect: []string{},
+			expectedSubtract:  []string{"10.4.0.0/24"},
+		},
+		{
+			name:              "case 2: adjacent networks which are not siblings",
+			a:                 []string{"10.4.1.0/24"},
+			b:                 []string{"10.4.2.0/24"},
+			expectedUnion:     []string{"10.4.1.0/24", "10.4.2.0/24"},
+			expectedIntersect: []string{},
+			expectedSubtract:  []string{"10.4.1.0/24"},
+		},
+		{
+			name:              "case 3: nested networks",
+			a:                 []string{"10.4.0.0/16"},
+			b:                 []string{"10.4.8.0/22"},
+			expectedUnion:     []string{"10.4.0.0/16"},
+			expectedIntersect: []string{"10.4.8.0/22"},
+			expectedSubtract:  []string{"10.4.0.0/21", "10.4.12.0/22", "10.4.16.0/20", "10.4.32.0/19", "10.4.64.0/18", "10.4.128.0/17"},
+			expectedOverlaps:  true,
+		},
+		{
+			name:              "case 4: duplicates and unaligned IPs are normalised",
+			a:                 []string{"10.4.0.5/24", "10.4.0.0/24", "10.4.0.128/25"},
+			b:                 []string{"10.4.0.0/24"},
+			expectedUnion:     []string{"10.4.0.0/24"},
+			expectedIntersect: []string{"10.4.0.0/24"},
+			expectedSubtract:  []string{},
+			expectedOverlaps:  true,
+			expectedEqual:     true,
+		},
+		{
+			name:              "case 5: subtract several networks",
+			a:                 []string{"10.4.0.0/22"},
+			b:                 []string{"10.4.0.0/24", "10.4.2.0/25", "10.4.3.128/25"},
+			expectedUnion:     []string{"10.4.0.0/22"},
+			expectedIntersect: []string{"10.4.0.0/24", "10.4.2.0/25", "10.4.3.128/25"},
+			expectedSubtract:  []string{"10.4.1.0/24", "10.4.2.128/25", "10.4.3.0/25"},
+			expectedOverlaps:  true,
+		},
+		{
+			name:              "case 6: mixed address families",
+			a:                 []string{"fd00::/64", "10.4.0.0/24"},
+			b:                 []string{"fd00::/65", "0.0.0.0/0"},
+			expectedUnion:     []string{"0.0.0.0/0", "fd00::/64"},
+			expectedIntersect: []string{"10.4.0.0/24", "fd00::/65"},
+			expectedSubtract:  []string{"fd00::8000:0:0:0/65"},
+			expectedOverlaps:  true,
+		},
+		{
+			name:              "case 7: ipv6 addresses with low values are not ipv4",
+			a:                 []string{"::/96"},
+			b:                 []string{"0.0.0.0/0"},
+			expectedUnion:     []string{"0.0.0.0/0", "::/96"},
+			expectedIntersect: []string{},
+			expectedSubtract:  []string{"::/96"},
+		},
+		{
+			name:              "case 8: whole address space",
+			a:                 []string{"0.0.0.0/1", "128.0.0.0/1"},
+			b:                 []string{"255.255.255.255/32"},
+			expectedUnion:     []string{"0.0.0.0/0"},
+			expectedIntersect: []string{"255.255.255.255/32"},
+			expectedSubtract:  []string{"0.0.0.0/1", "128.0.0.0/2", "192.0.0.0/3", "224.0.0.0/4", "240.0.0.0/5", "248.0.0.0/6", "252.0.0.0/7", "254.0.0.0/8", "255.0.0.0/9", "255.128.0.0/10", "255.192.0.0/11", "255.224.0.0/12", "255.240.0.0/13", "255.248.0.0/14", "255.252.0.0/15", "255.254.0.0/16", "255.255.0.0/17", "255.255.128.0/18", "255.255.192.0/19", "255.255.224.0/20", "255.255.240.0/21", "255.255.248.0/22", "255.255.252.0/23", "255.255.254.0/24", "255.255.255.0/25", "255.255.255.128/26", "255.255.255.192/27", "255.255.255.224/28", "255.255.255.240/29", "255.255.255.248/30", "255.255.255.252/31", "255.255.255.254/32"},
+			expectedOverlaps:  true,
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			a := NewCIDRSet(mustParseCIDRs(tc.a))
+			b := NewCIDRSet(mustParseCIDRs(tc.b))
+
+			results := []struct {
+				operation string
+				returned  []net.IPNet
+				expected  []string
+			}{
+				{operation: "union", returned: a.Union(b).CIDRs(), expected: tc.expectedUnion},
+				{operation: "intersect", returned: a.Intersect(b).CIDRs(), expected: tc.expectedIntersect},
+				{operation: "subtract", returned: a.Subtract(b).CIDRs(), expected: tc.expectedSubtract},
+			}
+			for _, r := range results {
+				returned := cidrStrings(r.returned)
+				if len(returned) != len(r.expected) {
+					t.Fatalf("%s == %v, want %v", r.operation, returned, r.expected)
+				}
+				for i := range returned {
+					if returned[i] != r.expected[i] {
+						t.Fatalf("%s == %v, want %v", r.operation, returned, r.expected)
+					}
+				}
+			}
+
+			if a.Overlaps(b) != tc.expectedOverlaps {
+				t.Fatalf("overlaps == %v, want %v", !tc.expectedOverlaps, tc.expectedOverlaps)
+			}
+			if a.Equal(b) != tc.expectedEqual {
+				t.Fatalf("equal == %v, want %v", !tc.expectedEqual, tc.expectedEqual)
+			}
+
+			// The union is the disjoint union of the intersection and both
+			// differences.
+			union := a.Intersect(b).Union(a.Subtract(b)).Union(b.Subtract(a))
+			if !union.Equal(a.Union(b)) {
+				t.Fatalf("union == %v, want %v", cidrStrings(union.CIDRs()), cidrStrings(a.Union(b).CIDRs()))
+			}
+		})
+	}
+}
+
+// TestCIDRSetContains tests the Contains method of CIDRSet.
+func TestCIDRSetContains(t *testing.T) {
+	set := NewCIDRSet(mustParseCIDRs([]string{"10.4.0.0/24", "10.4.1.0/24", "fd00::/64"}))
+
+	tests := []struct {
+		network          string
+		expectedContains bool
+	}{
+		{network: "10.4.0.0/23", expectedContains: true},
+		{network: "10.4.1.128/25", expectedContains: true},
+		{network: "10.4.0.0/22", expectedContains: false},
+		{network: "10.5.0.0/24", expectedContains: false},
+		{network: "fd00::/65", expectedContains: true},
+		{network: "fd00::/63", expectedContains: false},
+	}
+
+	for index, test := range tests {
+		contains := set.Contains(mustParseCIDR(test.network))
+		if contains != test.expectedContains {
+			t.Fatalf("%v: contains == %v, want %v", index, contains, test.expectedContains)
+		}
+	}
+}
@@ -2,8 +2,36 @@ package ipam
 
 import (
 	"net"
+	"time"
 )
 
+// Subnet is a subnet stored by the IPAM service, along with the annotation and
+// labels it was created with.
+type Subnet struct {
+	Network    net.IPNet
+	Annotation string
+	// Labels are the labels the subnet was created with, see
+	// CreateSubnetWithLabels.
+	Labels map[string]string
+	// Expires is the time after which the subnet is freed by Reap. It is
+	// zero for subnets which do not expire, see CreateSubnetWithTTL.
+	Expires time.Time
+}
+
+// Host is an address allocated by a HostAllocator, along with the annotation it
+// was allocated with.
+type Host struct {
+	IP         net.IP
+	Annotation string
+}
+
+// IPRange is a range of IPs, from Start to End, both inclusive, e.g. a free
+// range passed to Strategy.Space.
+type IPRange struct {
+	Start net.IP
+	End   net.IP
+}
+
 // ipRange defines a pair of IPs, over a range.
 type ipRange struct {
 	start net.IP
@@ -17,15 +45,71 @@ func (s ipNets) Len() int {
 	return len(s)
 }
 
-// Tuntion used to order nets, IP is checked first then Mask in case IP is the same
 func (s ipNets) Less(i, j int) bool {
-	if ipToDecimal(s[i].IP) == ipToDecimal(s[j].IP) {
-		return size(s[i].Mask) > size(s[j].Mask)
-	} else {
-		return ipToDecimal(s[i].IP) < ipToDecimal(s[j].IP)
-	}
+	return lessIPNet(s[i], s[j])
 }
 
 func (s ipNets) Swap(i, j int) {
 	s[i], s[j] = s[j], s[i]
 }
+
+// subnetsByNetwork is a helper type for sorting Subnets by their networks.
+type subnetsByNetwork []Subnet
+
+func (s subnetsByNetwork) Len() int {
+	return len(s)
+}
+
+func (s subnetsByNetwork) Less(i, j int) bool {
+	return lessIPNet(s[i].Network, s[j].Network)
+}
+
+func (s subnetsByNetwork) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// ipRanges is a helper type for sorting ipRanges by their start IPs.
+type ipRanges []ipRange
+
+func (s ipRanges) Len() int {
+	return len(s)
+}
+
+func (s ipRanges) Less(i, j int) bool {
+	return compareIP(s[i].start, s[j].start) < 0
+}
+
+func (s ipRanges) Swap(i, j int) {
+	s[i], s[j] = s[j], s[i]
+}
+
+// lessIPNet is the function used to order nets, IP is checked first then Mask
+// in case IP is the same. IPv4 nets are ordered before IPv6 nets.
+func lessIPNet(a, b net.IPNet) bool {
+	c := compareIP(a.IP, b.IP)
+	if c == 0 {
+		return size(a.Mask).Cmp(size(b.Mask)) > 0
+	} else {
+		return c < 0
+	}
+}
+
+// fromIPRanges converts the given ranges to exported IPRanges.
+func fromIPRanges(ranges []ipRange) []IPRange {
+	var converted []IPRange
+	for _, r := range ranges {
+		converted = append(converted, IPRange{Start: r.start, End: r.end})
+	}
+
+	return converted
+}
+
+// toIPRanges converts the given exported IPRanges to ranges.
+func toIPRanges(ranges []IPRange) []ipRange {
+	var converted []ipRange
+	for _, r := range ranges {
+		converted = append(converted, ipRange{start: r.Start, end: r.End})
+	}
+
+	return converted
+}
@@ -0,0 +1,117 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"math/big"
+	"net"
+
+	"github.com/giantswarm/microerror"
+)
+
+// NetworkStats describes the utilization and fragmentation of a network.
+type NetworkStats struct {
+	Network net.IPNet
+	// Allocated is the number of addresses within stored, allocated or
+	// excluded subnets.
+	Allocated *big.Int
+	// Free is the number of addresses not within any stored, allocated or
+	// excluded subnet.
+	Free *big.Int
+	// LargestFreeMask is the mask of the largest subnet which can still be
+	// allocated. It is nil when the network is exhausted.
+	LargestFreeMask net.IPMask
+	// FreeBlocks maps prefix lengths to the number of free blocks of that
+	// length, as returned by FreeBlocks.
+	FreeBlocks map[int]int
+	// Usable is the number of addresses within stored or allocated subnets
+	// which are usable by hosts, according to the configured profile.
+	Usable *big.Int
+}
+
+// Stats returns the utilization and fragmentation of each network returned by
+// Networks, in the same order. Stored, allocated and excluded subnets are not
+// free. The statistics are exported as metrics as well. The metrics are
+// refreshed after each change made by this service, e.g. by CreateSubnet or
+// DeleteSubnet, but changes made by other services sharing the same storage
+// and pool are only reflected once Stats is called.
+func (s *Service) Stats(ctx context.Context) ([]NetworkStats, error) {
+	networks, err := s.Networks(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	existingSubnets, err := s.listClaimedSubnets(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var subnets []net.IPNet
+	subnets = append(subnets, existingSubnets...)
+	subnets = append(subnets, s.allocatedSubnets...)
+
+	var stats []NetworkStats
+	for _, network := range networks {
+		st := networkStats(network, subnets, s.excluded, s.profile)
+		updateStatsMetrics(s.pool, st)
+
+		stats = append(stats, st)
+	}
+
+	return stats, nil
+}
+
+// refreshStats refreshes the statistics metrics after a successful mutation,
+// so that they do not go stale between calls to Stats. Errors are only
+// logged, as the mutation itself has succeeded.
+func (s *Service) refreshStats(ctx context.Context) {
+	_, err := s.Stats(ctx)
+	if err != nil {
+		s.logger.LogCtx(ctx, "level", "warning", "message", "failed to refresh stats metrics", "stack", fmt.Sprintf("%#v", err))
+	}
+}
+
+// networkStats returns the utilization and fragmentation of the given network,
+// given the allocated subnets, whose usable addresses are counted according to
+// the given profile, and the excluded ranges, which may overlap with the
+// network in any way.
+func networkStats(network net.IPNet, allocated []net.IPNet, excluded []net.IPNet, profile Profile) NetworkStats {
+	network.IP = network.IP.Mask(network.Mask)
+
+	stats := NetworkStats{
+		Network:    network,
+		Free:       big.NewInt(0),
+		FreeBlocks: map[int]int{},
+		Usable:     big.NewInt(0),
+	}
+
+	var counted []net.IPNet
+	for _, subnet := range allocated {
+		if !Contains(network, subnet) || containsIPNet(counted, subnet) {
+			continue
+		}
+		stats.Usable.Add(stats.Usable, profile.UsableCount(subnet))
+		counted = append(counted, subnet)
+	}
+
+	var taken []net.IPNet
+	taken = append(taken, allocated...)
+	taken = append(taken, excluded...)
+
+	largest := -1
+	for _, block := range FreeBlocks(network, taken) {
+		ones, _ := block.Mask.Size()
+
+		stats.Free.Add(stats.Free, size(block.Mask))
+		stats.FreeBlocks[ones]++
+
+		if largest == -1 || ones < largest {
+			largest = ones
+			stats.LargestFreeMask = block.Mask
+		}
+	}
+
+	stats.Allocated = size(network.Mask)
+	stats.Allocated.Sub(stats.Allocated, stats.Free)
+
+	return stats
+}
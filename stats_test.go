@@ -0,0 +1,146 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestNetworkStats tests the networkStats function.
+func TestNetworkStats(t *testing.T) {
+	tests := []struct {
+		network            string
+		allocated          []string
+		expectedAllocated  string
+		expectedFree       string
+		expectedLargest    int
+		expectedFreeBlocks map[int]int
+		expectedUsable     string
+	}{
+		{
+			network:            "10.4.0.0/16",
+			expectedAllocated:  "0",
+			expectedFree:       "65536",
+			expectedLargest:    16,
+			expectedFreeBlocks: map[int]int{16: 1},
+			expectedUsable:     "0",
+		},
+		{
+			network:            "10.4.0.0/22",
+			allocated:          []string{"10.4.1.0/24", "10.4.3.0/25"},
+			expectedAllocated:  "384",
+			expectedFree:       "640",
+			expectedLargest:    24,
+			expectedFreeBlocks: map[int]int{24: 2, 25: 1},
+			expectedUsable:     "380",
+		},
+		// Fragmented: plenty of free addresses, but no free /24.
+		{
+			network:            "10.4.0.0/23",
+			allocated:          []string{"10.4.0.0/26", "10.4.0.128/26", "10.4.1.0/26", "10.4.1.128/26"},
+			expectedAllocated:  "256",
+			expectedFree:       "256",
+			expectedLargest:    26,
+			expectedFreeBlocks: map[int]int{26: 4},
+			expectedUsable:     "248",
+		},
+		{
+			network:            "10.4.0.0/24",
+			allocated:          []string{"10.4.0.0/24"},
+			expectedAllocated:  "256",
+			expectedFree:       "0",
+			expectedLargest:    -1,
+			expectedFreeBlocks: map[int]int{},
+			expectedUsable:     "254",
+		},
+		{
+			network:            "fd00::/48",
+			allocated:          []string{"fd00::/64"},
+			expectedAllocated:  "18446744073709551616",
+			expectedFree:       "1208907372870555465154560",
+			expectedLargest:    49,
+			expectedFreeBlocks: map[int]int{49: 1, 50: 1, 51: 1, 52: 1, 53: 1, 54: 1, 55: 1, 56: 1, 57: 1, 58: 1, 59: 1, 60: 1, 61: 1, 62: 1, 63: 1, 64: 1},
+			expectedUsable:     "18446744073709551615",
+		},
+	}
+
+	for index, test := range tests {
+		stats := networkStats(mustParseCIDR(test.network), mustParseCIDRs(test.allocated), nil, ProfilePlain)
+
+		if stats.Allocated.String() != test.expectedAllocated {
+			t.Fatalf("%v: expected %v allocated, got %v", index, test.expectedAllocated, stats.Allocated)
+		}
+		if stats.Free.String() != test.expectedFree {
+			t.Fatalf("%v: expected %v free, got %v", index, test.expectedFree, stats.Free)
+		}
+
+		largest := -1
+		if stats.LargestFreeMask != nil {
+			largest, _ = stats.LargestFreeMask.Size()
+		}
+		if largest != test.expectedLargest {
+			t.Fatalf("%v: expected largest free prefix %v, got %v", index, test.expectedLargest, largest)
+		}
+
+		if !reflect.DeepEqual(stats.FreeBlocks, test.expectedFreeBlocks) {
+			t.Fatalf("%v: expected free blocks %v, got %v", index, test.expectedFreeBlocks, stats.FreeBlocks)
+		}
+		if stats.Usable.String() != test.expectedUsable {
+			t.Fatalf("%v: expected %v usable, got %v", index, test.expectedUsable, stats.Usable)
+		}
+	}
+}
+
+// TestStats tests that Service.Stats reports on every network of the pool.
+func TestStats(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/23")
+
+	service, err := New(Config{
+		Logger:           microloggertest.New(),
+		Storage:          storage,
+		Network:          &network,
+		AllocatedSubnets: []net.IPNet{mustParseCIDR("10.4.1.0/25")},
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	err = service.AddNetwork(ctx, mustParseCIDR("10.8.0.0/24"))
+	if err != nil {
+		t.Fatalf("unexpected error returned adding network: %v", err)
+	}
+	_, err = service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	_, err = service.CreateSubnet(ctx, net.CIDRMask(24, 32), "", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	stats, err := service.Stats(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting stats: %v", err)
+	}
+
+	if len(stats) != 2 {
+		t.Fatalf("expected stats of 2 networks, got %v", len(stats))
+	}
+	if stats[0].Network.String() != "10.4.0.0/23" || stats[0].Allocated.Int64() != 384 || stats[0].Free.Int64() != 128 {
+		t.Fatalf("unexpected stats of first network: %v %v %v", stats[0].Network.String(), stats[0].Allocated, stats[0].Free)
+	}
+	if stats[1].Network.String() != "10.8.0.0/24" || stats[1].Allocated.Int64() != 256 || stats[1].LargestFreeMask != nil {
+		t.Fatalf("unexpected stats of second network: %v %v %v", stats[1].Network.String(), stats[1].Allocated, stats[1].LargestFreeMask)
+	}
+}
@@ -0,0 +1,188 @@
+package ipam
+
+import (
+	"math/big"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/giantswarm/microerror"
+)
+
+// Strategy decides where within the free space of a network a subnet is
+// allocated. The built-in strategies are FirstFit, BestFit, LastFit and
+// RandomFit. Strategies may also be implemented outside of this package, the
+// subnets they return are verified to be aligned and free, see
+// FreeInNetworks.
+type Strategy interface {
+	// Space takes a list of free IP ranges, ordered by network and by IP
+	// within each network, and a mask, and returns the start IP of a subnet
+	// of the mask within one of the ranges. The built-in strategies return
+	// an error matched by IsSpaceExhausted when none of the ranges can hold
+	// such a subnet. Strategies outside of this package, which cannot
+	// create such errors, return a nil IP and no error instead, which
+	// FreeInNetworks reports as an error matched by IsSpaceExhausted.
+	Space(freeIPRanges []IPRange, mask net.IPMask) (net.IP, error)
+}
+
+// FirstFit allocates subnets from the lowest free block that can hold them.
+type FirstFit struct{}
+
+// Space implements Strategy.
+func (FirstFit) Space(freeIPRanges []IPRange, mask net.IPMask) (net.IP, error) {
+	ip, err := space(toIPRanges(freeIPRanges), mask)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	return ip, nil
+}
+
+// BestFit allocates subnets from the smallest free range that can hold them,
+// so that large free ranges are kept intact for large subnets.
+type BestFit struct{}
+
+// Space implements Strategy.
+func (BestFit) Space(freeIPRanges []IPRange, mask net.IPMask) (net.IP, error) {
+	_, maskBits := mask.Size()
+
+	var best *big.Int
+	var bestSize *big.Int
+	for _, freeIPRange := range toIPRanges(freeIPRanges) {
+		first, _, ok := alignedStarts(freeIPRange, mask)
+		if !ok {
+			continue
+		}
+
+		rangeSize := ipToDecimal(freeIPRange.end)
+		rangeSize.Sub(rangeSize, ipToDecimal(freeIPRange.start))
+		if bestSize == nil || rangeSize.Cmp(bestSize) < 0 {
+			best = first
+			bestSize = rangeSize
+		}
+	}
+
+	if best == nil {
+		return nil, microerror.Maskf(spaceExhaustedError, "tried to fit: %v", mask)
+	}
+
+	return decimalToIP(best, maskBits/8), nil
+}
+
+// LastFit allocates subnets from the top of the highest free block that can
+// hold them. When there are several networks, the last network is searched
+// first.
+type LastFit struct{}
+
+// Space implements Strategy.
+func (LastFit) Space(freeIPRanges []IPRange, mask net.IPMask) (net.IP, error) {
+	_, maskBits := mask.Size()
+
+	ranges := toIPRanges(freeIPRanges)
+	for i := len(ranges) - 1; i >= 0; i-- {
+		_, last, ok := alignedStarts(ranges[i], mask)
+		if ok {
+			return decimalToIP(last, maskBits/8), nil
+		}
+	}
+
+	return nil, microerror.Maskf(spaceExhaustedError, "tried to fit: %v", mask)
+}
+
+// RandomFit allocates subnets at a random position within the free space.
+// Every position able to hold the subnet is equally likely. The zero value
+// draws positions from a random source seeded with the current time, use
+// NewRandomFit for reproducible allocations.
+type RandomFit struct {
+	mutex sync.Mutex
+	rand  *rand.Rand
+}
+
+// NewRandomFit returns a RandomFit strategy, which draws positions from a
+// random source seeded with the given seed. Strategies created with the same
+// seed allocate the same subnets given the same calls.
+func NewRandomFit(seed int64) *RandomFit {
+	r := &RandomFit{
+		rand: rand.New(rand.NewSource(seed)),
+	}
+
+	return r
+}
+
+// Space implements Strategy.
+func (r *RandomFit) Space(freeIPRanges []IPRange, mask net.IPMask) (net.IP, error) {
+	_, maskBits := mask.Size()
+	maskSize := size(mask)
+
+	// Count the positions able to hold the subnet within each free range.
+	var firsts []*big.Int
+	var counts []*big.Int
+	total := big.NewInt(0)
+	for _, freeIPRange := range toIPRanges(freeIPRanges) {
+		first, last, ok := alignedStarts(freeIPRange, mask)
+		if !ok {
+			continue
+		}
+
+		count := new(big.Int).Sub(last, first)
+		count.Div(count, maskSize)
+		count.Add(count, big.NewInt(1))
+
+		firsts = append(firsts, first)
+		counts = append(counts, count)
+		total.Add(total, count)
+	}
+
+	if total.Sign() == 0 {
+		return nil, microerror.Maskf(spaceExhaustedError, "tried to fit: %v", mask)
+	}
+
+	r.mutex.Lock()
+	if r.rand == nil {
+		r.rand = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	n := new(big.Int).Rand(r.rand, total)
+	r.mutex.Unlock()
+
+	for i, count := range counts {
+		if n.Cmp(count) < 0 {
+			start := new(big.Int).Mul(n, maskSize)
+			start.Add(start, firsts[i])
+
+			return decimalToIP(start, maskBits/8), nil
+		}
+		n.Sub(n, count)
+	}
+
+	return nil, microerror.Maskf(spaceExhaustedError, "tried to fit: %v", mask)
+}
+
+// alignedStarts returns the first and the last start IP, as decimals, of a
+// subnet of the given mask within the given free range. ok is false when the
+// range cannot hold such a subnet.
+func alignedStarts(freeIPRange ipRange, mask net.IPMask) (first, last *big.Int, ok bool) {
+	maskSize := size(mask)
+
+	// Round the start of the range up to the next multiple of the subnet
+	// size.
+	first = ipToDecimal(freeIPRange.start)
+	remainder := new(big.Int).Mod(first, maskSize)
+	if remainder.Sign() != 0 {
+		first.Add(first, maskSize)
+		first.Sub(first, remainder)
+	}
+
+	// Round the end of the range, plus one, down to the next multiple of
+	// the subnet size, and step back one subnet.
+	last = ipToDecimal(freeIPRange.end)
+	last.Add(last, big.NewInt(1))
+	last.Sub(last, new(big.Int).Mod(last, maskSize))
+	last.Sub(last, maskSize)
+
+	if first.Cmp(last) > 0 {
+		return nil, nil, false
+	}
+
+	return first, last, true
+}
@@ -0,0 +1,267 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+func Test_FreeWithStrategy(t *testing.T) {
+	testCases := []struct {
+		name            string
+		network         net.IPNet
+		mask            int
+		subnets         []net.IPNet
+		strategy        Strategy
+		expectedNetwork net.IPNet
+		errorMatcher    func(error) bool
+	}{
+		{
+			name:    "case 0: first fit allocates from the lowest free block",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    28,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.128/26"),
+				mustParseCIDR("10.4.0.224/27"),
+			},
+			strategy:        FirstFit{},
+			expectedNetwork: mustParseCIDR("10.4.0.0/28"),
+		},
+		{
+			name:    "case 1: best fit allocates from the smallest free range",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    28,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.128/26"),
+				mustParseCIDR("10.4.0.224/27"),
+			},
+			strategy:        BestFit{},
+			expectedNetwork: mustParseCIDR("10.4.0.192/28"),
+		},
+		{
+			name:    "case 2: best fit skips smaller free ranges which can't hold the network",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    26,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.128/26"),
+				mustParseCIDR("10.4.0.224/27"),
+			},
+			strategy:        BestFit{},
+			expectedNetwork: mustParseCIDR("10.4.0.0/26"),
+		},
+		{
+			name:    "case 3: last fit allocates from the top of the highest free block",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    28,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.128/26"),
+				mustParseCIDR("10.4.0.224/27"),
+			},
+			strategy:        LastFit{},
+			expectedNetwork: mustParseCIDR("10.4.0.208/28"),
+		},
+		{
+			name:            "case 4: last fit in an empty network",
+			network:         mustParseCIDR("10.4.0.0/16"),
+			mask:            24,
+			strategy:        LastFit{},
+			expectedNetwork: mustParseCIDR("10.4.255.0/24"),
+		},
+		{
+			name:            "case 5: last fit in an empty IPv6 network",
+			network:         mustParseCIDR("fd00::/48"),
+			mask:            64,
+			strategy:        LastFit{},
+			expectedNetwork: mustParseCIDR("fd00:0:0:ffff::/64"),
+		},
+		{
+			name:    "case 6: best fit when the network is full",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    25,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.0/25"),
+				mustParseCIDR("10.4.0.192/26"),
+			},
+			strategy:     BestFit{},
+			errorMatcher: IsSpaceExhausted,
+		},
+		{
+			name:    "case 7: random fit when the network is full",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    25,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.0/25"),
+				mustParseCIDR("10.4.0.192/26"),
+			},
+			strategy:     NewRandomFit(0),
+			errorMatcher: IsSpaceExhausted,
+		},
+		{
+			name:    "case 8: random fit with a single position left",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    26,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.0/25"),
+				mustParseCIDR("10.4.0.192/26"),
+			},
+			strategy:        NewRandomFit(0),
+			expectedNetwork: mustParseCIDR("10.4.0.128/26"),
+		},
+		{
+			name:            "case 9: nil strategy behaves like first fit",
+			network:         mustParseCIDR("10.4.0.0/16"),
+			mask:            24,
+			strategy:        nil,
+			expectedNetwork: mustParseCIDR("10.4.0.0/24"),
+		},
+		{
+			name:    "case 10: zero value random fit with a single position left",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    26,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.0/25"),
+				mustParseCIDR("10.4.0.192/26"),
+			},
+			strategy:        &RandomFit{},
+			expectedNetwork: mustParseCIDR("10.4.0.128/26"),
+		},
+		{
+			name:            "case 11: custom strategy",
+			network:         mustParseCIDR("10.4.0.0/24"),
+			mask:            26,
+			strategy:        fixedStrategy{ip: net.ParseIP("10.4.0.64")},
+			expectedNetwork: mustParseCIDR("10.4.0.64/26"),
+		},
+		{
+			name:         "case 12: custom strategy finding no space",
+			network:      mustParseCIDR("10.4.0.0/24"),
+			mask:         26,
+			strategy:     fixedStrategy{},
+			errorMatcher: IsSpaceExhausted,
+		},
+		{
+			name:         "case 13: custom strategy returning an unaligned subnet",
+			network:      mustParseCIDR("10.4.0.0/24"),
+			mask:         26,
+			strategy:     fixedStrategy{ip: net.ParseIP("10.4.0.32")},
+			errorMatcher: IsInvalidParameter,
+		},
+		{
+			name:    "case 14: custom strategy returning an allocated subnet",
+			network: mustParseCIDR("10.4.0.0/24"),
+			mask:    26,
+			subnets: []net.IPNet{
+				mustParseCIDR("10.4.0.0/25"),
+			},
+			strategy:     fixedStrategy{ip: net.ParseIP("10.4.0.64")},
+			errorMatcher: IsOverlap,
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, bits := tc.network.Mask.Size()
+
+			network, err := FreeWithStrategy(tc.network, net.CIDRMask(tc.mask, bits), tc.subnets, tc.strategy)
+
+			switch {
+			case err == nil && tc.errorMatcher == nil:
+				// correct; carry on
+			case err != nil && tc.errorMatcher == nil:
+				t.Fatalf("error == %#v, want nil", err)
+			case err == nil && tc.errorMatcher != nil:
+				t.Fatalf("error == nil, want non-nil")
+			case !tc.errorMatcher(err):
+				t.Fatalf("error == %#v, want matching", err)
+			}
+
+			if tc.errorMatcher == nil && !ipNetEqual(network, tc.expectedNetwork) {
+				t.Fatalf("got %q, want %q", network.String(), tc.expectedNetwork.String())
+			}
+		})
+	}
+}
+
+// fixedStrategy is a Strategy, as implemented outside of this package, which
+// always returns the same IP.
+type fixedStrategy struct {
+	ip net.IP
+}
+
+func (f fixedStrategy) Space(freeIPRanges []IPRange, mask net.IPMask) (net.IP, error) {
+	return f.ip, nil
+}
+
+func Test_RandomFit(t *testing.T) {
+	network := mustParseCIDR("10.4.0.0/16")
+	mask := net.CIDRMask(24, 32)
+
+	draw := func(seed int64) []net.IPNet {
+		strategy := NewRandomFit(seed)
+
+		var subnets []net.IPNet
+		for i := 0; i < 16; i++ {
+			subnet, err := FreeWithStrategy(network, mask, subnets, strategy)
+			if err != nil {
+				t.Fatalf("error == %#v, want nil", err)
+			}
+			subnets = append(subnets, subnet)
+		}
+
+		return subnets
+	}
+
+	first := draw(42)
+	second := draw(42)
+
+	// The same seed yields the same subnets.
+	for i := range first {
+		if !ipNetEqual(first[i], second[i]) {
+			t.Fatalf("got %q, want %q", second[i].String(), first[i].String())
+		}
+	}
+
+	// The subnets are spread over the network rather than packed at the
+	// start of it.
+	var beyond int
+	for _, subnet := range first {
+		if !Contains(mustParseCIDR("10.4.0.0/20"), subnet) {
+			beyond++
+		}
+	}
+	if beyond == 0 {
+		t.Fatalf("expected random subnets, got %v", first)
+	}
+}
+
+func Test_Service_Strategy(t *testing.T) {
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:   microloggertest.New(),
+		Storage:  storage,
+		Network:  &network,
+		Strategy: LastFit{},
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	for _, expected := range []string{"10.4.255.0/24", "10.4.254.0/24"} {
+		subnet, err := service.CreateSubnet(context.Background(), net.CIDRMask(24, 32), "", nil)
+		if err != nil {
+			t.Fatalf("error == %#v, want nil", err)
+		}
+		if !ipNetEqual(subnet, mustParseCIDR(expected)) {
+			t.Fatalf("got %q, want %q", subnet.String(), expected)
+		}
+	}
+}
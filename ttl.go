@@ -0,0 +1,201 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/microstorage"
+)
+
+// RenewLease extends the lease of the given subnet, created with
+// CreateSubnetWithTTL, so that it expires after the given ttl from now. An
+// error matched by IsNotFound is returned when the subnet is not stored, e.g.
+// because it has expired and been freed already. An error matched by
+// IsInvalidParameter is returned when the subnet does not expire.
+func (s *Service) RenewLease(ctx context.Context, subnet net.IPNet, ttl time.Duration) error {
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("renewing lease of subnet %#q", subnet.String()))
+	defer updateMetrics(s.pool, "renew_lease", time.Now())
+
+	if ttl <= 0 {
+		return microerror.Maskf(invalidParameterError, "ttl %v must be positive", ttl)
+	}
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	defer unlock()
+
+	stored, err := s.GetSubnet(ctx, subnet)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+	if stored.Expires.IsZero() {
+		return microerror.Maskf(invalidParameterError, "subnet %#q does not have a lease", subnet.String())
+	}
+
+	if err := s.checkLock(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.putExpiry(ctx, subnet, s.clock().Add(ttl)); err != nil {
+		return microerror.Mask(err)
+	}
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("renewed lease of subnet %#q", subnet.String()))
+
+	return nil
+}
+
+// Reap frees all subnets whose lease has expired according to the configured
+// clock, and returns them ordered by network. Subnets delegated to child pools
+// which still hold subnets are kept until the child pools are empty.
+func (s *Service) Reap(ctx context.Context) ([]net.IPNet, error) {
+	s.logger.LogCtx(ctx, "level", "debug", "message", "reaping expired subnets")
+	defer updateMetrics(s.pool, "reap", time.Now())
+
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	defer unlock()
+
+	expiries, err := s.listExpiries(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	now := s.clock()
+
+	var reaped []net.IPNet
+	for cidr, expires := range expiries {
+		if now.Before(expires) {
+			continue
+		}
+
+		_, subnet, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		// An expiry may outlive its subnet, e.g. when the subnet has been
+		// deleted from the storage directly. It is deleted without
+		// reporting the subnet as reaped.
+		k, err := microstorage.NewK(encodeKey(s.pool, *subnet))
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		exists, err := s.storage.Exists(ctx, k)
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		if !exists {
+			if err := s.checkLock(ctx); err != nil {
+				return nil, microerror.Mask(err)
+			}
+			if err := s.delete(ctx, encodeExpiryKey(s.pool, *subnet)); err != nil {
+				return nil, microerror.Mask(err)
+			}
+			continue
+		}
+
+		err = s.deleteSubnet(ctx, *subnet)
+		if IsInUse(err) {
+			s.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("not reaping subnet %#q", subnet.String()), "stack", fmt.Sprintf("%#v", err))
+			continue
+		} else if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		reaped = append(reaped, *subnet)
+	}
+
+	sort.Sort(ipNets(reaped))
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("reaped %d expired subnets", len(reaped)))
+
+	return reaped, nil
+}
+
+// RunReaper calls Reap every interval until the context is done. Errors
+// returned by Reap are logged, so that a single failure does not stop the
+// reaper.
+func (s *Service) RunReaper(ctx context.Context, interval time.Duration) error {
+	for {
+		_, err := s.Reap(ctx)
+		if err != nil {
+			s.logger.LogCtx(ctx, "level", "error", "message", "failed to reap expired subnets", "stack", fmt.Sprintf("%#v", err))
+		}
+
+		err = sleep(ctx, interval)
+		if err != nil {
+			return microerror.Mask(err)
+		}
+	}
+}
+
+// putExpiry stores the time after which the given subnet expires.
+func (s *Service) putExpiry(ctx context.Context, subnet net.IPNet, expires time.Time) error {
+	err := s.put(ctx, encodeExpiryKey(s.pool, subnet), expires.UTC().Format(time.RFC3339Nano))
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
+
+// searchExpiry returns the time after which the given subnet expires, or the
+// zero time if it does not expire.
+func (s *Service) searchExpiry(ctx context.Context, subnet net.IPNet) (time.Time, error) {
+	k, err := microstorage.NewK(encodeExpiryKey(s.pool, subnet))
+	if err != nil {
+		return time.Time{}, microerror.Mask(err)
+	}
+	kv, err := s.storage.Search(ctx, k)
+	if microstorage.IsNotFound(err) {
+		return time.Time{}, nil
+	} else if err != nil {
+		return time.Time{}, microerror.Mask(err)
+	}
+
+	expires, err := time.Parse(time.RFC3339Nano, kv.Val())
+	if err != nil {
+		return time.Time{}, microerror.Mask(err)
+	}
+
+	return expires, nil
+}
+
+// listExpiries returns the times after which the subnets with a lease expire,
+// keyed by the CIDR notation of the subnets.
+func (s *Service) listExpiries(ctx context.Context) (map[string]time.Time, error) {
+	k, err := microstorage.NewK(poolKey(s.pool, ipamExpiryStorageKey))
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kvs, err := s.storage.List(ctx, k)
+	if err != nil && !microstorage.IsNotFound(err) {
+		return nil, microerror.Mask(err)
+	}
+
+	expiries := map[string]time.Time{}
+	for _, kv := range kvs {
+		_, subnet, err := net.ParseCIDR(decodeKey(kv.Key()))
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+		expires, err := time.Parse(time.RFC3339Nano, kv.Val())
+		if err != nil {
+			return nil, microerror.Mask(err)
+		}
+
+		expiries[subnet.String()] = expires
+	}
+
+	return expiries, nil
+}
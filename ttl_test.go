@@ -0,0 +1,190 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestCreateSubnetWithTTL tests that subnets created with a ttl are freed by
+// Reap once they expire, unless their lease is renewed.
+func TestCreateSubnetWithTTL(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	mask := net.CIDRMask(24, 32)
+
+	permanent, err := service.CreateSubnet(ctx, mask, "permanent", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	short, err := service.CreateSubnetWithTTL(ctx, mask, "short", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	renewed, err := service.CreateSubnetWithTTL(ctx, mask, "renewed", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	subnet, err := service.GetSubnet(ctx, short)
+	if err != nil {
+		t.Fatalf("unexpected error returned getting subnet: %v", err)
+	}
+	if !subnet.Expires.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expires == %v, want %v", subnet.Expires, now.Add(time.Hour))
+	}
+
+	now = now.Add(30 * time.Minute)
+
+	err = service.RenewLease(ctx, renewed, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error returned renewing lease: %v", err)
+	}
+	err = service.RenewLease(ctx, permanent, time.Hour)
+	if !IsInvalidParameter(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+
+	reaped, err := service.Reap(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned reaping subnets: %v", err)
+	}
+	if len(reaped) != 0 {
+		t.Fatalf("reaped == %v, want none", reaped)
+	}
+
+	now = now.Add(45 * time.Minute)
+
+	reaped, err = service.Reap(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned reaping subnets: %v", err)
+	}
+	if len(reaped) != 1 || !ipNetEqual(reaped[0], short) {
+		t.Fatalf("reaped == %v, want [%v]", reaped, short.String())
+	}
+
+	subnets, err := service.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	if len(subnets) != 2 || !ipNetEqual(subnets[0].Network, permanent) || !ipNetEqual(subnets[1].Network, renewed) {
+		t.Fatalf("subnets == %v, want [%v %v]", subnets, permanent.String(), renewed.String())
+	}
+	if !subnets[0].Expires.IsZero() {
+		t.Fatalf("expires == %v, want zero", subnets[0].Expires)
+	}
+	if !subnets[1].Expires.Equal(now.Add(15 * time.Minute)) {
+		t.Fatalf("expires == %v, want %v", subnets[1].Expires, now.Add(15*time.Minute))
+	}
+
+	err = service.RenewLease(ctx, short, time.Hour)
+	if !IsNotFound(err) {
+		t.Fatalf("error == %#v, want matching", err)
+	}
+
+	// The reaped subnet is handed out again, and does not inherit the
+	// expiry of its previous allocation.
+	reused, err := service.CreateSubnet(ctx, mask, "reused", nil)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+	if !ipNetEqual(reused, short) {
+		t.Fatalf("subnet == %v, want %v", reused.String(), short.String())
+	}
+
+	now = now.Add(time.Hour)
+
+	reaped, err = service.Reap(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned reaping subnets: %v", err)
+	}
+	if len(reaped) != 1 || !ipNetEqual(reaped[0], renewed) {
+		t.Fatalf("reaped == %v, want [%v]", reaped, renewed.String())
+	}
+}
+
+// TestReapStaleExpiry tests that Reap deletes expiries whose subnet is gone
+// without reporting the subnet as reaped.
+func TestReapStaleExpiry(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+		Network: &network,
+		Clock: func() time.Time {
+			return now
+		},
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	subnet, err := service.CreateSubnetWithTTL(ctx, net.CIDRMask(24, 32), "", nil, time.Hour)
+	if err != nil {
+		t.Fatalf("unexpected error returned creating subnet: %v", err)
+	}
+
+	k, err := microstorage.NewK(encodeKey("", subnet))
+	if err != nil {
+		t.Fatalf("unexpected error creating key: %v", err)
+	}
+	if err := storage.Delete(ctx, k); err != nil {
+		t.Fatalf("unexpected error deleting key: %v", err)
+	}
+
+	now = now.Add(2 * time.Hour)
+
+	reaped, err := service.Reap(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned reaping subnets: %v", err)
+	}
+	if len(reaped) != 0 {
+		t.Fatalf("reaped == %v, want none", reaped)
+	}
+
+	k, err = microstorage.NewK(encodeExpiryKey("", subnet))
+	if err != nil {
+		t.Fatalf("unexpected error creating key: %v", err)
+	}
+	exists, err := storage.Exists(ctx, k)
+	if err != nil {
+		t.Fatalf("unexpected error checking key: %v", err)
+	}
+	if exists {
+		t.Fatalf("expected expiry of subnet %v to be deleted", subnet.String())
+	}
+}
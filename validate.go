@@ -0,0 +1,279 @@
+package ipam
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/giantswarm/microerror"
+	"github.com/giantswarm/microstorage"
+)
+
+// ProblemKind is the kind of a Problem found by Validate.
+type ProblemKind string
+
+const (
+	// ProblemAllocatedOverlap is a stored subnet which overlaps with one of
+	// the allocated subnets of the configuration.
+	ProblemAllocatedOverlap ProblemKind = "allocatedOverlap"
+	// ProblemExcludedOverlap is a stored subnet which overlaps with one of
+	// the excluded ranges of the configuration.
+	ProblemExcludedOverlap ProblemKind = "excludedOverlap"
+	// ProblemMalformedKey is a storage key below the subnet keys which does
+	// not denote a subnet, e.g. /ipam/subnet/10.4.0.0-33.
+	ProblemMalformedKey ProblemKind = "malformedKey"
+	// ProblemOutsideNetwork is a stored subnet which is not contained by any
+	// of the networks returned by Networks, e.g. because the configured
+	// network has been changed.
+	ProblemOutsideNetwork ProblemKind = "outsideNetwork"
+	// ProblemOverlap is a stored subnet which overlaps with another stored
+	// subnet.
+	ProblemOverlap ProblemKind = "overlap"
+)
+
+// Problem is an inconsistency between the stored subnets and the
+// configuration, found by Validate or Repair.
+type Problem struct {
+	Kind ProblemKind
+	// Key is the storage key of the subnet.
+	Key string
+	// Subnet is the stored subnet. It is empty for malformed keys.
+	Subnet net.IPNet
+	// Other is the subnet overlapping with Subnet, for overlaps.
+	Other net.IPNet
+	// Repaired is true when the problem has been repaired by Repair.
+	Repaired bool
+}
+
+// String returns a human readable description of the problem.
+func (p Problem) String() string {
+	switch p.Kind {
+	case ProblemAllocatedOverlap:
+		return fmt.Sprintf("stored subnet %#q overlaps with allocated subnet %#q", p.Subnet.String(), p.Other.String())
+	case ProblemExcludedOverlap:
+		return fmt.Sprintf("stored subnet %#q overlaps with excluded range %#q", p.Subnet.String(), p.Other.String())
+	case ProblemMalformedKey:
+		return fmt.Sprintf("storage key %#q is malformed", p.Key)
+	case ProblemOutsideNetwork:
+		return fmt.Sprintf("stored subnet %#q is outside of the networks", p.Subnet.String())
+	case ProblemOverlap:
+		return fmt.Sprintf("stored subnet %#q overlaps with stored subnet %#q", p.Subnet.String(), p.Other.String())
+	}
+
+	return fmt.Sprintf("%s problem with storage key %#q", p.Kind, p.Key)
+}
+
+// Validate compares the stored subnets with the configuration, and returns the
+// problems found, i.e. malformed storage keys, stored subnets outside of the
+// networks returned by Networks, stored subnets overlapping with each other,
+// and stored subnets overlapping with allocated subnets or excluded ranges.
+// It is meant to be called after New, e.g. on startup, and does not change
+// anything.
+func (s *Service) Validate(ctx context.Context) ([]Problem, error) {
+	s.logger.LogCtx(ctx, "level", "debug", "message", "validating stored subnets")
+	defer updateMetrics(s.pool, "validate", time.Now())
+
+	problems, err := s.validate(ctx, false)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("validated stored subnets, found %d problems", len(problems)))
+
+	return problems, nil
+}
+
+// Repair is like Validate, but deletes malformed storage keys, and stored
+// subnets outside of the networks along with everything stored for them,
+// like DeleteSubnet does, except that their dual-stack partners are kept.
+// Subnets delegated to child pools which still hold subnets are kept.
+// Overlapping subnets are only reported, as it is not known which of them is
+// in use. The returned problems tell which have been repaired.
+func (s *Service) Repair(ctx context.Context) ([]Problem, error) {
+	s.logger.LogCtx(ctx, "level", "debug", "message", "repairing stored subnets")
+	defer updateMetrics(s.pool, "repair", time.Now())
+
+	problems, err := s.validate(ctx, true)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	s.refreshStats(ctx)
+
+	s.logger.LogCtx(ctx, "level", "debug", "message", fmt.Sprintf("repaired stored subnets, found %d problems", len(problems)))
+
+	return problems, nil
+}
+
+// validate returns the problems of the stored subnets, repairing those which
+// can be repaired safely when repair is true.
+func (s *Service) validate(ctx context.Context, repair bool) ([]Problem, error) {
+	unlock, err := s.lock(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	defer unlock()
+
+	prefix := poolKey(s.pool, ipamSubnetStorageKey)
+	k, err := microstorage.NewK(prefix)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+	kvs, err := s.storage.List(ctx, k)
+	if err != nil && !microstorage.IsNotFound(err) {
+		return nil, microerror.Mask(err)
+	}
+
+	sort.Slice(kvs, func(i, j int) bool {
+		return kvs[i].Key() < kvs[j].Key()
+	})
+
+	networks, err := s.Networks(ctx)
+	if err != nil {
+		return nil, microerror.Mask(err)
+	}
+
+	var problems []Problem
+	var stored []net.IPNet
+	for _, kv := range kvs {
+		key := fmt.Sprintf("%s/%s", prefix, strings.TrimPrefix(kv.Key(), "/"))
+
+		// Keys of unaligned subnets, e.g. 10.4.0.5-16, are parsed, but are
+		// never written, nor found when deleting the subnet.
+		_, subnet, err := net.ParseCIDR(decodeKey(kv.Key()))
+		if err != nil || encodeKey(s.pool, *subnet) != key {
+			problems = append(problems, Problem{
+				Kind: ProblemMalformedKey,
+				Key:  key,
+			})
+			continue
+		}
+
+		var contained bool
+		for _, network := range networks {
+			if Contains(network, *subnet) {
+				contained = true
+				break
+			}
+		}
+		if !contained {
+			problems = append(problems, Problem{
+				Kind:   ProblemOutsideNetwork,
+				Key:    key,
+				Subnet: *subnet,
+			})
+			continue
+		}
+
+		stored = append(stored, *subnet)
+	}
+
+	sort.Sort(ipNets(stored))
+	for i, subnet := range stored {
+		for _, other := range stored[i+1:] {
+			if overlaps(subnet, other) {
+				problems = append(problems, Problem{
+					Kind:   ProblemOverlap,
+					Key:    encodeKey(s.pool, subnet),
+					Subnet: subnet,
+					Other:  other,
+				})
+			}
+		}
+		for _, allocated := range s.allocatedSubnets {
+			if overlaps(subnet, allocated) {
+				problems = append(problems, Problem{
+					Kind:   ProblemAllocatedOverlap,
+					Key:    encodeKey(s.pool, subnet),
+					Subnet: subnet,
+					Other:  allocated,
+				})
+			}
+		}
+		for _, excluded := range s.excluded {
+			if overlaps(subnet, excluded) {
+				problems = append(problems, Problem{
+					Kind:   ProblemExcludedOverlap,
+					Key:    encodeKey(s.pool, subnet),
+					Subnet: subnet,
+					Other:  excluded,
+				})
+			}
+		}
+	}
+
+	for i, p := range problems {
+		s.logger.LogCtx(ctx, "level", "warning", "message", p.String())
+
+		if !repair {
+			continue
+		}
+
+		switch p.Kind {
+		case ProblemMalformedKey:
+			if err := s.checkLock(ctx); err != nil {
+				return nil, microerror.Mask(err)
+			}
+			if err := s.delete(ctx, p.Key); err != nil {
+				return nil, microerror.Mask(err)
+			}
+			problems[i].Repaired = true
+		case ProblemOutsideNetwork:
+			err := s.deleteStoredSubnet(ctx, p.Subnet)
+			if IsInUse(err) {
+				s.logger.LogCtx(ctx, "level", "warning", "message", fmt.Sprintf("not repairing subnet %#q", p.Subnet.String()), "stack", fmt.Sprintf("%#v", err))
+				continue
+			} else if err != nil {
+				return nil, microerror.Mask(err)
+			}
+			problems[i].Repaired = true
+		}
+	}
+
+	return problems, nil
+}
+
+// deleteStoredSubnet deletes the given subnet and everything stored for it,
+// like DeleteSubnet does, but keeps its dual-stack partner, whose link to the
+// subnet is deleted instead. It must only be called while holding the lock.
+func (s *Service) deleteStoredSubnet(ctx context.Context, subnet net.IPNet) error {
+	subnets := []net.IPNet{subnet}
+
+	if err := s.undelegate(ctx, subnets); err != nil {
+		return microerror.Mask(err)
+	}
+
+	partner, err := s.searchPartner(ctx, subnet)
+	if err != nil {
+		return microerror.Mask(err)
+	}
+
+	if err := s.checkLock(ctx); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.deleteOwners(ctx, subnets); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.deleteHosts(ctx, subnets); err != nil {
+		return microerror.Mask(err)
+	}
+	if err := s.delete(ctx, encodeExpiryKey(s.pool, subnet)); err != nil {
+		return microerror.Mask(err)
+	}
+	if partner != nil {
+		if err := s.delete(ctx, encodePairKey(s.pool, *partner)); err != nil {
+			return microerror.Mask(err)
+		}
+		if err := s.delete(ctx, encodePairKey(s.pool, subnet)); err != nil {
+			return microerror.Mask(err)
+		}
+	}
+	if err := s.delete(ctx, encodeKey(s.pool, subnet)); err != nil {
+		return microerror.Mask(err)
+	}
+
+	return nil
+}
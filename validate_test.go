@@ -0,0 +1,160 @@
+package ipam
+
+import (
+	"context"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/giantswarm/micrologger/microloggertest"
+	"github.com/giantswarm/microstorage"
+	"github.com/giantswarm/microstorage/memory"
+)
+
+// TestValidate tests that Validate reports the problems of the stored subnets
+// without changing them, and that Repair deletes malformed keys and subnets
+// outside of the network.
+func TestValidate(t *testing.T) {
+	ctx := context.Background()
+
+	storage, err := memory.New(memory.Config{})
+	if err != nil {
+		t.Fatalf("error creating new storage: %v", err)
+	}
+
+	network := mustParseCIDR("10.4.0.0/16")
+
+	service, err := New(Config{
+		Logger:  microloggertest.New(),
+		Storage: storage,
+
+		AllocatedSubnets: []net.IPNet{mustParseCIDR("10.4.255.0/24")},
+		Excluded:         []net.IPNet{mustParseCIDR("10.4.254.0/23")},
+		Network:          &network,
+	})
+	if err != nil {
+		t.Fatalf("error returned creating ipam service: %v", err)
+	}
+
+	problems, err := service.Validate(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned validating: %v", err)
+	}
+	if len(problems) != 0 {
+		t.Fatalf("expected no problems, got %v", problems)
+	}
+
+	// Write the keys directly, as the service would never write them.
+	kvs := map[string]string{
+		"/ipam/subnet/10.4.0.0-24":   "",
+		"/ipam/subnet/10.4.0.128-25": "",
+		"/ipam/subnet/10.4.1.5-24":   "",
+		"/ipam/subnet/10.4.255.0-25": "",
+		"/ipam/subnet/10.5.0.0-24":   "",
+		"/ipam/subnet/garbage":       "",
+		"/ipam/owner/cluster-x":      "10.5.0.0/24",
+	}
+	for key, val := range kvs {
+		kv, err := microstorage.NewKV(key, val)
+		if err != nil {
+			t.Fatalf("unexpected error creating kv: %v", err)
+		}
+		if err := storage.Put(ctx, kv); err != nil {
+			t.Fatalf("unexpected error storing kv: %v", err)
+		}
+	}
+
+	expectedProblems := []Problem{
+		{
+			Kind: ProblemMalformedKey,
+			Key:  "/ipam/subnet/10.4.1.5-24",
+		},
+		{
+			Kind:   ProblemOutsideNetwork,
+			Key:    "/ipam/subnet/10.5.0.0-24",
+			Subnet: mustParseCIDR("10.5.0.0/24"),
+		},
+		{
+			Kind: ProblemMalformedKey,
+			Key:  "/ipam/subnet/garbage",
+		},
+		{
+			Kind:   ProblemOverlap,
+			Key:    "/ipam/subnet/10.4.0.0-24",
+			Subnet: mustParseCIDR("10.4.0.0/24"),
+			Other:  mustParseCIDR("10.4.0.128/25"),
+		},
+		{
+			Kind:   ProblemAllocatedOverlap,
+			Key:    "/ipam/subnet/10.4.255.0-25",
+			Subnet: mustParseCIDR("10.4.255.0/25"),
+			Other:  mustParseCIDR("10.4.255.0/24"),
+		},
+		{
+			Kind:   ProblemExcludedOverlap,
+			Key:    "/ipam/subnet/10.4.255.0-25",
+			Subnet: mustParseCIDR("10.4.255.0/25"),
+			Other:  mustParseCIDR("10.4.254.0/23"),
+		},
+	}
+
+	// Validating twice returns the same problems, as nothing is changed.
+	for i := 0; i < 2; i++ {
+		problems, err := service.Validate(ctx)
+		if err != nil {
+			t.Fatalf("unexpected error returned validating: %v", err)
+		}
+		if !reflect.DeepEqual(problems, expectedProblems) {
+			t.Fatalf("expected problems %v, got %v", expectedProblems, problems)
+		}
+	}
+
+	problems, err = service.Repair(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned repairing: %v", err)
+	}
+	for i := range expectedProblems[:3] {
+		expectedProblems[i].Repaired = true
+	}
+	if !reflect.DeepEqual(problems, expectedProblems) {
+		t.Fatalf("expected problems %v, got %v", expectedProblems, problems)
+	}
+
+	for _, key := range []string{"/ipam/subnet/10.4.1.5-24", "/ipam/subnet/10.5.0.0-24", "/ipam/subnet/garbage", "/ipam/owner/cluster-x"} {
+		k, err := microstorage.NewK(key)
+		if err != nil {
+			t.Fatalf("unexpected error creating key: %v", err)
+		}
+		exists, err := storage.Exists(ctx, k)
+		if err != nil {
+			t.Fatalf("unexpected error checking key: %v", err)
+		}
+		if exists {
+			t.Fatalf("expected key %#q to be deleted", key)
+		}
+	}
+
+	subnets, err := service.ListSubnets(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned listing subnets: %v", err)
+	}
+	var networks []net.IPNet
+	for _, subnet := range subnets {
+		networks = append(networks, subnet.Network)
+	}
+	sort.Sort(ipNets(networks))
+	expectedSubnets := []string{"10.4.0.0/24", "10.4.0.128/25", "10.4.255.0/25"}
+	if !reflect.DeepEqual(cidrStrings(networks), expectedSubnets) {
+		t.Fatalf("expected subnets %v, got %v", expectedSubnets, cidrStrings(networks))
+	}
+
+	// The overlaps are left to the operator.
+	problems, err = service.Validate(ctx)
+	if err != nil {
+		t.Fatalf("unexpected error returned validating: %v", err)
+	}
+	if !reflect.DeepEqual(problems, expectedProblems[3:]) {
+		t.Fatalf("expected problems %v, got %v", expectedProblems[3:], problems)
+	}
+}